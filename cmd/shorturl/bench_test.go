@@ -87,3 +87,69 @@ func BenchmarkShortenBatchPostgres(b *testing.B) {
 		}
 	})
 }
+
+func benchmarkRedirect(b *testing.B, args ...string) {
+	os.Args = append([]string{os.Args[0]}, args...)
+	cli := setUpEmptyStorage(b)
+	key := cli.Shorten(sampleURL, app.DefaultBaseURL)
+
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			resp := cli.GET("/" + key)
+			resp.Body.Close()
+		}
+	})
+}
+
+func BenchmarkRedirectInMemory(b *testing.B) {
+	benchmarkRedirect(b, "-f", "", "--cache-size", "0")
+}
+
+func BenchmarkRedirectInMemoryCached(b *testing.B) {
+	benchmarkRedirect(b, "-f", "")
+}
+
+func BenchmarkRedirectPostgres(b *testing.B) {
+	benchmarkRedirect(b, "-d", app.DefaultDatabaseDsn, "--cache-size", "0")
+}
+
+func BenchmarkRedirectPostgresCached(b *testing.B) {
+	benchmarkRedirect(b, "-d", app.DefaultDatabaseDsn)
+}
+
+// The high parallelism benchmarks run 64 client goroutines per CPU.
+const highParallelism = 64
+
+func BenchmarkShortenInMemoryHighParallelism(b *testing.B) {
+	os.Args = []string{os.Args[0], "-f", ""}
+	cli := setUpEmptyStorage(b)
+
+	b.SetParallelism(highParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			resp := cli.POST("", "text/plain", sampleURL)
+			resp.Body.Close()
+		}
+	})
+}
+
+func BenchmarkRedirectInMemoryHighParallelism(b *testing.B) {
+	os.Args = []string{os.Args[0], "-f", "", "--cache-size", "0"}
+	cli := setUpEmptyStorage(b)
+
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = cli.Shorten(sampleURL+"/path"+strconv.Itoa(i), app.DefaultBaseURL)
+	}
+
+	b.SetParallelism(highParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for i := 0; p.Next(); i++ {
+			resp := cli.GET("/" + keys[i%len(keys)])
+			resp.Body.Close()
+		}
+	})
+}
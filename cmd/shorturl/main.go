@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/hrashk/shorturl/internal/app"
 )
 
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	mods, err := newSettings().parse()
 	if err != nil {
@@ -20,7 +28,36 @@ func main() {
 		panic(err)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			if err := server.ReopenLogs(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+
+		// The grace period and the in-flight requests have to fit in the timeout.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		done <- server.Shutdown(shutdownCtx)
+	}()
+
 	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
+	stop()
+	if err := <-done; err != nil {
+		fmt.Fprintln(os.Stderr, "failed to shut down:", err)
+		os.Exit(1)
+	}
 }
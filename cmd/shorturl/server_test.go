@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"net"
-	"net/http"
 	"os"
 	"strings"
 	"testing"
@@ -17,8 +16,8 @@ import (
 
 type mainServer struct {
 	t             testing.TB
-	origNewServer func(modifiers ...app.Configurator) (*http.Server, error)
-	server        *http.Server
+	origNewServer func(modifiers ...app.Configurator) (*app.Server, error)
+	server        *app.Server
 	baseURL       string
 	ch            chan struct{}
 }
@@ -33,7 +32,7 @@ func newServer(tb testing.TB) *mainServer {
 	return ms
 }
 
-func (ms *mainServer) spy(modifiers ...app.Configurator) (*http.Server, error) {
+func (ms *mainServer) spy(modifiers ...app.Configurator) (*app.Server, error) {
 	srv, err := ms.origNewServer(modifiers...)
 
 	if err == nil && srv != nil {
@@ -73,9 +72,11 @@ func (ms *mainServer) wipeData() {
 }
 
 func (ms *mainServer) deleteFiles() {
-	ms.deleteFile(app.DefaultStoragePath)
-	ms.deleteFile(samplePath)
-	ms.deleteFile(anotherPath)
+	for _, path := range []string{app.DefaultStoragePath, samplePath, anotherPath} {
+		ms.deleteFile(path)
+		ms.deleteFile(path + ".clicks")
+		ms.deleteFile(path + ".visitors")
+	}
 }
 
 func (ms *mainServer) wipeDB() {
@@ -85,9 +86,9 @@ func (ms *mainServer) wipeDB() {
 		return
 	}
 
-	_, err = db.Exec("drop table if exists urls")
+	_, err = db.Exec("drop table if exists urls, clicks, visitor_sketches, secrets, rate_limits")
 	if err != nil {
-		ms.t.Logf("Unable to drop table urls: %v", err)
+		ms.t.Logf("Unable to drop tables: %v", err)
 		return
 	}
 }
@@ -54,6 +54,261 @@ var dbSetting = setting{
 	cfg:      app.WithDatabaseDsn,
 }
 
+var sweepIntervalSetting = setting{
+	name: "sweep-interval",
+	usage: "how often expired links are purged from storage, e.g. 30s or 5m. " +
+		"Zero value disables purging. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultSweepInterval,
+	envName:  "SWEEP_INTERVAL",
+	cfg:      app.WithSweepInterval,
+}
+
+var shutdownGracePeriodSetting = setting{
+	name: "shutdown-grace-period",
+	usage: "how long the server keeps serving with a failing readiness probe before it shuts down, e.g. 5s. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultShutdownGracePeriod,
+	envName:  "SHUTDOWN_GRACE_PERIOD",
+	cfg:      app.WithShutdownGracePeriod,
+}
+
+var redirectTypeSetting = setting{
+	name: "redirect-type",
+	usage: "default HTTP status of redirects: 301, 302, 307 or 308. " +
+		"Links can override it at creation. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultRedirectType,
+	envName:  "REDIRECT_TYPE",
+	cfg:      app.WithRedirectType,
+}
+
+var ipHashSaltSetting = setting{
+	name: "ip-hash-salt",
+	usage: "secret mixed into the hashes of client IP addresses recorded with clicks, " +
+		"generated and kept with the data when empty. " +
+		"Related environment variable %s has higher priority.",
+	defValue: "",
+	envName:  "IP_HASH_SALT",
+	cfg:      app.WithIPHashSalt,
+}
+
+var traceExporterSetting = setting{
+	name: "trace-exporter",
+	usage: "OpenTelemetry trace exporter: none, stdout or otlp. " +
+		"The otlp exporter is configured with the standard OTEL_EXPORTER_OTLP_* environment variables. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultTraceExporter,
+	envName:  "TRACE_EXPORTER",
+	cfg:      app.WithTraceExporter,
+}
+
+var logLevelSetting = setting{
+	name: "log-level",
+	usage: "minimum level of logged messages: debug, info, warn or error. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultLogLevel,
+	envName:  "LOG_LEVEL",
+	cfg:      app.WithLogLevel,
+}
+
+var accessLogFormatSetting = setting{
+	name: "access-log-format",
+	usage: "access log format: json, common or combined for the Apache Common and Combined Log Formats. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultAccessLogFormat,
+	envName:  "ACCESS_LOG_FORMAT",
+	cfg:      app.WithAccessLogFormat,
+}
+
+var accessLogFileSetting = setting{
+	name: "access-log-file",
+	usage: "access log file path. " +
+		"Empty value means the access log goes to the standard output. " +
+		"The file is reopened on SIGHUP. " +
+		"Related environment variable %s has higher priority.",
+	defValue: "",
+	envName:  "ACCESS_LOG_FILE",
+	cfg:      app.WithAccessLogPath,
+}
+
+var accessLogMaxSizeSetting = setting{
+	name: "access-log-max-size",
+	usage: "size in megabytes at which the access log file is rotated. " +
+		"Zero value disables rotation. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultAccessLogMaxSizeMB,
+	envName:  "ACCESS_LOG_MAX_SIZE",
+	cfg:      app.WithAccessLogMaxSize,
+}
+
+var accessLogSampleSetting = setting{
+	name: "access-log-sample",
+	usage: "log only every n-th redirect. Other requests are always logged. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultAccessLogSample,
+	envName:  "ACCESS_LOG_SAMPLE",
+	cfg:      app.WithAccessLogSample,
+}
+
+var cacheSizeSetting = setting{
+	name: "cache-size",
+	usage: "maximum number of links cached in memory in front of the storage. " +
+		"Zero value disables the cache. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultCacheSize,
+	envName:  "CACHE_SIZE",
+	cfg:      app.WithCacheSize,
+}
+
+var cacheTTLSetting = setting{
+	name: "cache-ttl",
+	usage: "how long cached links are used, e.g. 30s. " +
+		"It bounds how long the changes made by other instances may go unnoticed. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultCacheTTL,
+	envName:  "CACHE_TTL",
+	cfg:      app.WithCacheTTL,
+}
+
+var cacheMissesSetting = setting{
+	name: "cache-misses",
+	usage: "whether the unknown keys are cached too, so that the keys created by other instances " +
+		"may be missing for up to the cache TTL. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultCacheMisses,
+	envName:  "CACHE_MISSES",
+	cfg:      app.WithCacheMisses,
+}
+
+var bloomFPRateSetting = setting{
+	name: "bloom-fp-rate",
+	usage: "false positive rate of the bloom filter of existing keys, e.g. 0.01. " +
+		"The filter answers the lookups of nonexistent keys without querying the storage. " +
+		"Zero value disables the filter. Keep it disabled when several instances share the database. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultBloomFPRate,
+	envName:  "BLOOM_FP_RATE",
+	cfg:      app.WithBloomFPRate,
+}
+
+var compressMinSizeSetting = setting{
+	name: "compress-min-size",
+	usage: "size in bytes below which responses are not compressed. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultCompressMinSize,
+	envName:  "COMPRESS_MIN_SIZE",
+	cfg:      app.WithCompressMinSize,
+}
+
+var maxBodySizeSetting = setting{
+	name: "max-body-size",
+	usage: "max size in bytes of a request body as received. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultMaxBodySize,
+	envName:  "MAX_BODY_SIZE",
+	cfg:      app.WithMaxBodySize,
+}
+
+var maxDecompressedBodySizeSetting = setting{
+	name: "max-decompressed-body-size",
+	usage: "max size in bytes of a compressed request body after decompression. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultMaxDecompressedBodySize,
+	envName:  "MAX_DECOMPRESSED_BODY_SIZE",
+	cfg:      app.WithMaxDecompressedBodySize,
+}
+
+var shortenRateLimitSetting = setting{
+	name: "shorten-rate-limit",
+	usage: "requests per client IP to the shortening endpoints like 100/m, per s, m or h, or 0 for no limit. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultShortenRateLimit,
+	envName:  "SHORTEN_RATE_LIMIT",
+	cfg:      app.WithShortenRateLimit,
+}
+
+var redirectRateLimitSetting = setting{
+	name: "redirect-rate-limit",
+	usage: "requests per client IP to the short links like 1000/m, per s, m or h, or 0 for no limit. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultRedirectRateLimit,
+	envName:  "REDIRECT_RATE_LIMIT",
+	cfg:      app.WithRedirectRateLimit,
+}
+
+var rateLimitStoreSetting = setting{
+	name: "rate-limit-store",
+	usage: "where the rate limits are counted: memory, or postgres to share them between instances " +
+		"in the postgresql database of the connection string. Related environment variable %s has higher priority.",
+	defValue: app.DefaultRateLimitStore,
+	envName:  "RATE_LIMIT_STORE",
+	cfg:      app.WithRateLimitStore,
+}
+
+var trustedProxiesSetting = setting{
+	name: "trusted-proxies",
+	usage: "comma separated CIDRs of the proxies whose Forwarded and X-Forwarded-* headers are trusted. " +
+		"Related environment variable %s has higher priority.",
+	defValue: "",
+	envName:  "TRUSTED_PROXIES",
+	cfg:      app.WithTrustedProxies,
+}
+
+var allowedSchemesSetting = setting{
+	name: "allowed-schemes",
+	usage: "comma separated schemes of the URLs that can be shortened. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultAllowedSchemes,
+	envName:  "ALLOWED_SCHEMES",
+	cfg:      app.WithAllowedSchemes,
+}
+
+var maxURLLengthSetting = setting{
+	name: "max-url-length",
+	usage: "max length in bytes of the URLs that can be shortened. " +
+		"Related environment variable %s has higher priority.",
+	defValue: app.DefaultMaxURLLength,
+	envName:  "MAX_URL_LENGTH",
+	cfg:      app.WithMaxURLLength,
+}
+
+var domainPolicySetting = setting{
+	name: "domain-policy",
+	usage: "file with the allow and deny rules of the domains that can be shortened and followed. " +
+		"Related environment variable %s has higher priority.",
+	defValue: "",
+	envName:  "DOMAIN_POLICY",
+	cfg:      app.WithDomainPolicy,
+}
+
+var threatListSetting = setting{
+	name: "threat-list",
+	usage: "file of Safe Browsing hash prefixes or plain hosts and URLs of the malicious sites. " +
+		"Related environment variable %s has higher priority.",
+	defValue: "",
+	envName:  "THREAT_LIST",
+	cfg:      app.WithThreatList,
+}
+
+var templatesDirSetting = setting{
+	name: "templates-dir",
+	usage: "directory of the HTML templates replacing the built-in ones, e.g. preview.html. " +
+		"Related environment variable %s has higher priority.",
+	defValue: "",
+	envName:  "TEMPLATES_DIR",
+	cfg:      app.WithTemplatesDir,
+}
+
+var adminTokenSetting = setting{
+	name: "admin-token",
+	usage: "bearer token of the admin endpoints, which are disabled without it. " +
+		"Related environment variable %s has higher priority.",
+	defValue: "",
+	envName:  "ADMIN_TOKEN",
+	cfg:      app.WithAdminToken,
+}
+
 type settings struct {
 	fs  *flag.FlagSet
 	all []*setting
@@ -61,8 +316,19 @@ type settings struct {
 
 func newSettings() settings {
 	ss := settings{
-		fs:  flag.NewFlagSet(os.Args[0], flag.ContinueOnError),
-		all: []*setting{&addrSetting, &baseURLSetting, &storagePathSetting, &dbSetting},
+		fs: flag.NewFlagSet(os.Args[0], flag.ContinueOnError),
+		all: []*setting{
+			&addrSetting, &baseURLSetting, &storagePathSetting, &dbSetting,
+			&sweepIntervalSetting, &redirectTypeSetting, &ipHashSaltSetting,
+			&traceExporterSetting, &logLevelSetting, &accessLogFormatSetting,
+			&accessLogFileSetting, &accessLogMaxSizeSetting, &accessLogSampleSetting,
+			&cacheSizeSetting, &cacheTTLSetting, &cacheMissesSetting, &bloomFPRateSetting,
+			&compressMinSizeSetting, &maxBodySizeSetting, &maxDecompressedBodySizeSetting,
+			&shortenRateLimitSetting, &redirectRateLimitSetting, &rateLimitStoreSetting,
+			&trustedProxiesSetting, &allowedSchemesSetting, &maxURLLengthSetting,
+			&domainPolicySetting, &threatListSetting, &adminTokenSetting,
+			&templatesDirSetting, &shutdownGracePeriodSetting,
+		},
 	}
 	ss.declareAll()
 
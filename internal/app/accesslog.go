@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	accessLogJSON     = "json"
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+)
+
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes an entry per request either to the application log
+// or, when a file is configured, to a file of its own.
+type accessLog struct {
+	format string
+	out    io.Writer // nil means the application log
+	json   logger
+	// Only every sample-th redirect is logged. Other responses are always logged.
+	sample    int64
+	redirects *atomic.Int64
+}
+
+func newAccessLog(cfg config) (accessLog, error) {
+	al := accessLog{
+		format:    cfg.accessLogFormat,
+		sample:    cfg.accessLogSample,
+		redirects: &atomic.Int64{},
+	}
+
+	if cfg.accessLogPath != "" {
+		rf, err := openRotatingFile(cfg.accessLogPath, cfg.accessLogMaxSize)
+		if err != nil {
+			return al, err
+		}
+		al.out = rf
+	} else if al.format != accessLogJSON {
+		al.out = os.Stdout
+	}
+
+	if al.out != nil {
+		al.json = zeroLogger{logger: zerolog.New(al.out).With().Timestamp().Logger()}
+	}
+
+	return al, nil
+}
+
+// reopen lets external tools like logrotate move the file away, see Server.ReopenLogs.
+func (al accessLog) reopen() error {
+	if rf, ok := al.out.(*rotatingFile); ok {
+		return rf.reopen()
+	}
+	return nil
+}
+
+func (al accessLog) close(context.Context) error {
+	if rf, ok := al.out.(*rotatingFile); ok {
+		return rf.close()
+	}
+	return nil
+}
+
+func (al accessLog) sampled(status int) bool {
+	if al.sample <= 1 || status < 300 || status >= 400 {
+		return true
+	}
+	return (al.redirects.Add(1)-1)%al.sample == 0
+}
+
+func (al accessLog) write(l logger, r *http.Request, rw *loggingResponseWriter, start time.Time) {
+	if !al.sampled(rw.status) {
+		return
+	}
+
+	switch al.format {
+	case accessLogCommon:
+		io.WriteString(al.out, commonLogLine(r, rw, start)+"\n")
+	case accessLogCombined:
+		io.WriteString(al.out, combinedLogLine(r, rw, start)+"\n")
+	default:
+		if al.out != nil {
+			l = al.json.With("request_id", rw.Header().Get(requestIDHeader))
+		}
+		l.With(
+			"uri", r.RequestURI,
+			"method", r.Method,
+			"status", rw.status,
+			"duration", time.Since(start),
+			"size", rw.size,
+			"remote_ip", clientIP(r),
+			"scheme", requestScheme(r),
+		).Info("request")
+	}
+}
+
+// commonLogLine is in the Apache Common Log Format.
+func commonLogLine(r *http.Request, rw *loggingResponseWriter, start time.Time) string {
+	size := "-"
+	if rw.size > 0 {
+		size = strconv.Itoa(rw.size)
+	}
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+	request := fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto)
+
+	return fmt.Sprintf("%s - %s [%s] %s %d %s", clientIP(r), user, start.Format(clfTimeLayout),
+		strconv.Quote(request), rw.status, size)
+}
+
+// combinedLogLine is in the Apache Combined Log Format.
+func combinedLogLine(r *http.Request, rw *loggingResponseWriter, start time.Time) string {
+	return fmt.Sprintf("%s %s %s", commonLogLine(r, rw, start),
+		quoteOrDash(r.Referer()), quoteOrDash(r.UserAgent()))
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// rotatingFile renames the file with a timestamp suffix and starts a new one
+// when the next write would exceed the max size. Zero max size disables rotation.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open replaces the current file with the one at the path. The current file is kept
+// if the path can't be opened, so that the entries aren't lost.
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", rf.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat file %s: %w", rf.path, err)
+	}
+	if rf.f != nil {
+		rf.f.Close()
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the open file, which keeps taking the writes until the new one is opened.
+func (rf *rotatingFile) rotate() error {
+	rotated := rf.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate file %s: %w", rf.path, err)
+	}
+	return rf.open()
+}
+
+// reopen lets external tools like logrotate move the file away.
+func (rf *rotatingFile) reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.open()
+}
+
+func (rf *rotatingFile) close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.f.Close()
+}
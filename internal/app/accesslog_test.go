@@ -0,0 +1,64 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	rf, err := openRotatingFile(path, 10)
+	require.NoError(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		_, err = rf.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	files, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	assert.Len(t, files, 2, "Rotated files")
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "third\n", string(b), "Current file")
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	rf, err := openRotatingFile(path, 0)
+	require.NoError(t, err)
+
+	_, err = rf.Write([]byte("before\n"))
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, rf.reopen())
+	_, err = rf.Write([]byte("after\n"))
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "after\n", string(b), "Reopened file")
+}
+
+func TestRotatingFileReopenFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	require.NoError(t, os.Mkdir(dir, 0755))
+
+	rf, err := openRotatingFile(filepath.Join(dir, "access.log"), 0)
+	require.NoError(t, err)
+	defer rf.close()
+
+	require.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, rf.reopen(), "Missing directory")
+	_, err = rf.Write([]byte("kept\n"))
+	assert.NoError(t, err, "Writes to the old file")
+}
@@ -1,37 +1,101 @@
 package app
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type adapter struct {
-	svc service
-	log logger
+	svc          service
+	log          logger
+	redirectType int
+	redirectAge  time.Duration // the longest a permanent redirect may be cached
+	reg          *prometheus.Registry
+	metrics      httpMetrics
+	tracer       trace.Tracer
+	accessLog    accessLog
+	draining     *atomic.Bool
+	compressMin  int
+	maxBody      int64
+	maxInflated  int64
+	rateLimits   rateLimits
+	proxies      trustedProxies
+	adminToken   string
+	previewTmpl  *template.Template
 }
 
 func newAdapter(cfg config) (adapter, error) {
+	al, err := newAccessLog(cfg)
+	if err != nil {
+		return adapter{}, err
+	}
+	rls, err := newRateLimits(cfg)
+	if err != nil {
+		return adapter{}, err
+	}
+	pt, err := loadPreviewTemplate(cfg.templatesDir)
+	if err != nil {
+		return adapter{}, err
+	}
 	s, err := newService(cfg)
+	redirectAge := permanentRedirectMaxAge
+	if cfg.domainPolicyPath != "" || cfg.threatListPath != "" {
+		redirectAge = recheckedRedirectMaxAge
+	}
 
-	return adapter{s, cfg.log}, err
+	return adapter{s, cfg.log, cfg.redirectType, redirectAge,
+		cfg.metrics, newHTTPMetrics(cfg.metrics), cfg.tracer.Tracer(tracerName), al, &atomic.Bool{}, cfg.compressMinSize,
+		cfg.maxBodySize, cfg.maxDecompressedBodySize, rls, cfg.trustedProxies, cfg.adminToken, pt}, err
+}
+
+// drain fails the readiness checks so that no new traffic is routed to the server.
+func (a adapter) drain() {
+	a.draining.Store(true)
 }
 
 func (a adapter) handler() http.Handler {
 	r := chi.NewRouter()
-	r.Use(loggingMiddleware(a.log))
-	r.Use(newGzipDeflator())
-	r.Use(newGzipInflator())
+	r.Use(tracingMiddleware(a.tracer))
+	r.Use(proxyMiddleware(a.proxies))
+	r.Use(requestIDMiddleware(a.log))
+	r.Use(loggingMiddleware(a.log, a.accessLog))
+	r.Use(metricsMiddleware(a.metrics))
+	r.Use(newDeflator(a.compressMin))
+	r.Use(newInflator(a.maxBody, a.maxInflated))
 
 	r.Get("/ping", a.Ping)
-	r.Get("/{key}", a.RedirectToOriginalURL)
-	r.Post("/", a.CreateShortURL)
-	r.Post("/api/shorten", a.ShortenAPI)
-	r.Post("/api/shorten/batch", a.ShortenBatch)
+	r.Get("/healthz", a.Healthz)
+	r.Get("/readyz", a.Readyz)
+	r.Method(http.MethodGet, "/metrics", metricsHandler(a.reg))
+
+	redirects := r.With(a.rateLimits.middleware("redirect", a.rateLimits.redirect))
+	redirects.Get("/{key}", a.RedirectToOriginalURL)
+	redirects.Get("/{key}/*", a.RedirectToOriginalURL)
+	redirects.Post("/{key}", a.UnlockOriginalURL)
+	redirects.Post("/{key}/*", a.UnlockOriginalURL)
+	redirects.Get("/{key}/qr", a.QRCode)
+
+	shortens := r.With(a.rateLimits.middleware("shorten", a.rateLimits.shorten))
+	shortens.Post("/", a.CreateShortURL)
+	shortens.Post("/api/shorten", a.ShortenAPI)
+	shortens.Post("/api/shorten/batch", a.ShortenBatch)
+
+	r.Get("/api/urls/{key}/stats", a.Stats)
+	if a.adminToken != "" {
+		r.With(adminOnly(a.adminToken)).Get("/api/admin/flagged", a.FlaggedLinks)
+	}
 	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Operation is not supported", http.StatusBadRequest)
 	})
@@ -42,16 +106,18 @@ func (a adapter) handler() http.Handler {
 func (a adapter) CreateShortURL(w http.ResponseWriter, r *http.Request) {
 	url, err := originalURL(r)
 	if err != nil {
-		badRequest(w, err)
+		unreadableBody(w, err)
 		return
 	}
 
-	shortURL, err := a.svc.CreateShortURL(r.Context(), url)
+	shortURL, err := a.svc.CreateShortURL(r.Context(), url, LinkOptions{})
 
 	if errors.Is(err, ErrConflict) {
 		conflict(w, shortURL)
+	} else if errors.Is(err, ErrInvalidRequest) {
+		badRequest(w, err)
 	} else if err != nil {
-		serverError(w, err)
+		a.serverError(w, r, err)
 	} else {
 		created(w, shortURL)
 	}
@@ -67,7 +133,8 @@ func created(w http.ResponseWriter, shortURL string) {
 	io.WriteString(w, shortURL)
 }
 
-func serverError(w http.ResponseWriter, err error) {
+func (a adapter) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	ctxLogger(r.Context(), a.log).Error(err, "%s %s", r.Method, r.URL.Path)
 	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
@@ -79,6 +146,14 @@ func notFound(w http.ResponseWriter, err error) {
 	http.Error(w, err.Error(), http.StatusNotFound)
 }
 
+func forbidden(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
+
+func gone(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusGone)
+}
+
 func originalURL(r *http.Request) (string, error) {
 	raw, err := io.ReadAll(r.Body)
 
@@ -90,42 +165,190 @@ func originalURL(r *http.Request) (string, error) {
 }
 
 func (a adapter) RedirectToOriginalURL(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Path[1:]
+	key := chi.URLParam(r, "key")
+	if k, ok := previewKey(r, key); ok && trailingPath(r, key) == "" {
+		a.preview(w, r, k)
+		return
+	}
 
-	url, err := a.svc.LookUp(r.Context(), key)
-	if err != nil {
+	l, err := a.svc.LookUp(r.Context(), key)
+	if err == nil {
+		err = checkTrailingPath(l, r, key)
+	}
+	// the click of a protected link is consumed once the password is given
+	if err == nil && !l.protected() {
+		l, err = a.svc.ConsumeClick(r.Context(), l)
+	}
+
+	if errors.Is(err, ErrGone) {
+		a.metrics.redirects.WithLabelValues("gone").Inc()
+		gone(w, err)
+		return
+	} else if errors.Is(err, ErrBlocked) {
+		a.metrics.redirects.WithLabelValues("blocked").Inc()
+		forbidden(w, err)
+		return
+	} else if errors.Is(err, ErrMalicious) {
+		a.metrics.redirects.WithLabelValues("flagged").Inc()
+		if l.protected() {
+			passwordForm(w, http.StatusOK, "")
+		} else if err = warningPage(w, l.originalURL); err != nil {
+			a.serverError(w, r, err)
+		}
+		return
+	} else if err != nil {
+		a.metrics.redirects.WithLabelValues("miss").Inc()
 		notFound(w, err)
 		return
 	}
+	a.metrics.redirects.WithLabelValues("hit").Inc()
+
+	if l.protected() {
+		passwordForm(w, http.StatusOK, "")
+		return
+	}
+
+	a.redirect(w, r, l)
+}
+
+// preview shows where the link goes instead of redirecting.
+func (a adapter) preview(w http.ResponseWriter, r *http.Request, key string) {
+	p, err := a.svc.Preview(r.Context(), key)
+	switch {
+	case errors.Is(err, ErrGone):
+		gone(w, err)
+	case errors.Is(err, ErrBlocked):
+		forbidden(w, err)
+	case err != nil:
+		notFound(w, err)
+	default:
+		if err = previewPage(w, a.previewTmpl, p); err != nil {
+			a.serverError(w, r, err)
+		}
+	}
+}
+
+const (
+	// permanent redirects are cached by browsers for at most that long
+	permanentRedirectMaxAge = 365 * 24 * time.Hour
+	// unless the destinations may get blocked or flagged later on
+	recheckedRedirectMaxAge = 5 * time.Minute
+)
+
+func (a adapter) redirect(w http.ResponseWriter, r *http.Request, l link) {
+	status := l.redirectType
+	if status == 0 {
+		status = a.redirectType
+	}
+
+	w.Header().Set("Cache-Control", redirectCacheControl(l, status, a.redirectAge, time.Now()))
+	http.Redirect(w, r, destination(l, r), status)
+
+	a.svc.RecordClick(newClick(r, l.shortURL))
+}
+
+func checkTrailingPath(l link, r *http.Request, key string) error {
+	if !l.passthrough && trailingPath(r, key) != "" {
+		return fmt.Errorf("key %v does not pass through path %v", key, r.URL.Path)
+	}
+	return nil
+}
+
+func destination(l link, r *http.Request) string {
+	if !l.passthrough {
+		return l.originalURL
+	}
+
+	dest, err := passThrough(l.originalURL, r, l.shortURL)
+	if err != nil {
+		return l.originalURL // not a valid URL to pass anything through
+	}
+	return dest
+}
+
+// Links that must be looked up on every click are never cached,
+// even when redirected permanently.
+func redirectCacheControl(l link, status int, maxAge time.Duration, now time.Time) string {
+	permanent := status == http.StatusMovedPermanently || status == http.StatusPermanentRedirect
+	if !permanent || l.clickLimited() || l.protected() {
+		return "private, no-cache"
+	}
+
+	if !l.expiresAt.IsZero() {
+		maxAge = min(maxAge, l.expiresAt.Sub(now))
+	}
+	return fmt.Sprintf("public, max-age=%d", int64(maxAge.Seconds()))
+}
+
+// UnlockOriginalURL handles the password form of a protected link.
+func (a adapter) UnlockOriginalURL(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+
+	l, err := a.svc.Unlock(r.Context(), key, r.PostFormValue("password"))
+	if err == nil {
+		err = checkTrailingPath(l, r, key)
+	}
+	if err == nil {
+		l, err = a.svc.ConsumeClick(r.Context(), l)
+	}
+	switch {
+	case errors.Is(err, ErrWrongPassword):
+		passwordForm(w, http.StatusForbidden, "Wrong password, try again.")
+	case errors.Is(err, ErrTooManyAttempts):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, ErrGone):
+		gone(w, err)
+	case errors.Is(err, ErrBlocked):
+		forbidden(w, err)
+	case errors.Is(err, ErrMalicious):
+		if err = warningPage(w, l.originalURL); err != nil {
+			a.serverError(w, r, err)
+		}
+	case err != nil:
+		notFound(w, err)
+	default:
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, destination(l, r), http.StatusSeeOther)
 
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+		a.svc.RecordClick(newClick(r, l.shortURL))
+	}
 }
 
 type ShortURLRequest struct {
 	URL string `json:"url"`
+	QR  bool   `json:"qr,omitempty"` // whether to return the address of the QR code, too
+	LinkOptions
 }
 
 type ShortURLResponse struct {
 	Result string `json:"result"`
+	QR     string `json:"qr,omitempty"`
 }
 
 func (a adapter) ShortenAPI(w http.ResponseWriter, r *http.Request) {
 	req, err := bind(r)
 	if err != nil {
-		badRequest(w, err)
+		unreadableBody(w, err)
 		return
 	}
 
-	shortURL, err := a.svc.CreateShortURL(r.Context(), req.URL)
+	shortURL, err := a.svc.CreateShortURL(r.Context(), req.URL, req.LinkOptions)
+	resp := ShortURLResponse{Result: shortURL}
+	// a duplicate has the short URL of the stored link, any other failure has none
+	if req.QR && (err == nil || errors.Is(err, ErrConflict)) {
+		resp.QR = qrURL(shortURL)
+	}
 
 	if errors.Is(err, ErrConflict) {
-		err = conflictAPI(w, shortURL)
+		err = conflictAPI(w, resp)
+	} else if errors.Is(err, ErrInvalidRequest) {
+		err = badRequestAPI(w, err)
 	} else if err == nil {
-		err = createdAPI(w, shortURL)
+		err = createdAPI(w, resp)
 	}
 
 	if err != nil {
-		serverError(w, err)
+		a.serverError(w, r, err)
 	}
 }
 
@@ -139,16 +362,30 @@ func bind(r *http.Request) (ShortURLRequest, error) {
 	return req, err
 }
 
-func createdAPI(w http.ResponseWriter, shortURL string) error {
-	resp := ShortURLResponse{shortURL}
+func createdAPI(w http.ResponseWriter, resp ShortURLResponse) error {
 	return writeJSON(w, resp, http.StatusCreated)
 }
 
-func conflictAPI(w http.ResponseWriter, shortURL string) error {
-	resp := ShortURLResponse{shortURL}
+func conflictAPI(w http.ResponseWriter, resp ShortURLResponse) error {
 	return writeJSON(w, resp, http.StatusConflict)
 }
 
+// ErrorResponse is the body of the API errors. The reason is a stable code
+// of the invalid URLs, see InvalidURLError.
+type ErrorResponse struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func badRequestAPI(w http.ResponseWriter, err error) error {
+	resp := ErrorResponse{Error: err.Error()}
+	var invalid *InvalidURLError
+	if errors.As(err, &invalid) {
+		resp.Reason = invalid.Reason
+	}
+	return writeJSON(w, resp, http.StatusBadRequest)
+}
+
 func writeJSON(w http.ResponseWriter, resp any, status int) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -162,24 +399,26 @@ func writeJSON(w http.ResponseWriter, resp any, status int) error {
 
 func (a adapter) Ping(w http.ResponseWriter, r *http.Request) {
 	if err := a.svc.PingDB(r.Context()); err != nil {
-		serverError(w, err)
+		a.serverError(w, r, err)
 	}
 }
 
 func (a adapter) ShortenBatch(w http.ResponseWriter, r *http.Request) {
 	req, err := bindBatch(r)
 	if err != nil {
-		badRequest(w, err)
+		unreadableBody(w, err)
 		return
 	}
 
 	resp, err := a.svc.ShortenBatch(r.Context(), req)
-	if err == nil {
+	if errors.Is(err, ErrInvalidRequest) {
+		err = badRequestAPI(w, err)
+	} else if err == nil {
 		err = writeJSON(w, resp, http.StatusCreated)
 	}
 
 	if err != nil {
-		serverError(w, err)
+		a.serverError(w, r, err)
 	}
 }
 
@@ -191,3 +430,74 @@ func bindBatch(r *http.Request) (BatchRequest, error) {
 	}
 	return req, err
 }
+
+func (a adapter) FlaggedLinks(w http.ResponseWriter, r *http.Request) {
+	flagged, err := a.svc.FlaggedLinks(r.Context())
+	if err == nil {
+		err = writeJSON(w, flagged, http.StatusOK)
+	}
+
+	if err != nil {
+		a.serverError(w, r, err)
+	}
+}
+
+// adminOnly lets in the requests with the admin token in the Authorization header.
+func adminOnly(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasBearerToken(r, token) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, "admin token required", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func hasBearerToken(r *http.Request, token string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// QRCode draws the short URL of the key, so a passthrough link can't pass /qr through.
+func (a adapter) QRCode(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseQROptions(r.URL.Query())
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	shortURL, err := a.svc.ShortURL(r.Context(), chi.URLParam(r, "key"))
+	if errors.Is(err, ErrGone) {
+		gone(w, err)
+		return
+	} else if err != nil {
+		notFound(w, err)
+		return
+	}
+
+	image, contentType, err := qrImage(shortURL, opts)
+	if err != nil {
+		a.serverError(w, r, err)
+		return
+	}
+	serveQR(w, r, image, contentType)
+}
+
+func (a adapter) Stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.svc.Stats(r.Context(), chi.URLParam(r, "key"))
+	if errors.Is(err, errNotFound) {
+		notFound(w, err)
+		return
+	} else if err != nil {
+		a.serverError(w, r, err)
+		return
+	}
+
+	if err = writeJSON(w, stats, http.StatusOK); err != nil {
+		a.serverError(w, r, err)
+	}
+}
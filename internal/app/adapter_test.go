@@ -1,30 +1,73 @@
 package app
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/skip2/go-qrcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type AdapterSuite struct {
 	suite.Suite
 	srv *httptest.Server
 	cli Client
+	adp adapter
 }
 
 func TestControllerSuite(t *testing.T) {
 	suite.Run(t, &AdapterSuite{})
 }
 
+func (as *AdapterSuite) SetupSuite() {
+	passwordHashCost = bcrypt.MinCost
+}
+
+func (as *AdapterSuite) TearDownSuite() {
+	passwordHashCost = bcrypt.DefaultCost
+}
+
 func (as *AdapterSuite) SetupTest() {
-	cfg, err := newConfig(WithLogger(as), WithMemoryStorage())
+	as.startServer()
+}
+
+func (as *AdapterSuite) restartServer(modifiers ...Configurator) {
+	as.srv.Close()
+	as.startServer(modifiers...)
+}
+
+func (as *AdapterSuite) startServer(modifiers ...Configurator) {
+	modifiers = append([]Configurator{WithLogger(as), WithMemoryStorage()}, modifiers...)
+	cfg, err := newConfig(modifiers...)
 	as.Require().NoError(err)
 
 	a, err := newAdapter(cfg)
 	as.Require().NoError(err)
 
+	as.adp = a
 	as.srv = httptest.NewServer(a.handler())
 	as.cli = NewClient(as.T())
 	as.cli.BaseURL = as.srv.URL
@@ -66,15 +109,29 @@ func (as *AdapterSuite) TestShortenApi() {
 	as.Equal(6, len(key))
 }
 
+func (as *AdapterSuite) Debug(msg string, v ...any) {
+	testLogger{t: as.T()}.Debug(msg, v...)
+}
+
 func (as *AdapterSuite) Info(msg string, v ...any) {
-	as.T().Logf(msg, v...)
+	testLogger{t: as.T()}.Info(msg, v...)
+}
+
+func (as *AdapterSuite) Warn(msg string, v ...any) {
+	testLogger{t: as.T()}.Warn(msg, v...)
 }
 
 func (as *AdapterSuite) Error(err error, msg string, v ...any) {
-	as.T().Logf(msg+": error "+err.Error(), v...)
+	testLogger{t: as.T()}.Error(err, msg, v...)
+}
+
+func (as *AdapterSuite) With(kv ...any) logger {
+	return testLogger{t: as.T()}.With(kv...)
 }
 
 func (as *AdapterSuite) TestReceivingGzip() {
+	as.restartServer(WithCompressMinSize("0"))
+
 	resp := as.cli.PostAcceptingGzip("/api/shorten", `{"url": "https://pkg.go.dev/cmp"}`)
 	defer resp.Body.Close()
 
@@ -85,6 +142,82 @@ func (as *AdapterSuite) TestReceivingGzip() {
 	as.Contains(body, DefaultBaseURL, "body")
 }
 
+func (as *AdapterSuite) TestReceivingBrotliAndZstd() {
+	as.restartServer(WithCompressMinSize("0"))
+
+	decoders := map[string]func(r io.Reader) (io.Reader, error){
+		"br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+
+	for encoding, decode := range decoders {
+		resp := as.cli.PostAccepting("/api/shorten", encoding, `{"url": "https://pkg.go.dev/`+encoding+`"}`)
+		defer resp.Body.Close()
+
+		as.Equal(http.StatusCreated, resp.StatusCode, "Response status code")
+		as.Equal(encoding, resp.Header.Get("Content-Encoding"), "Content encoding")
+
+		body, err := decode(resp.Body)
+		as.Require().NoError(err)
+		as.Contains(as.cli.readBody(body), DefaultBaseURL, "Decompressed body")
+	}
+}
+
+func (as *AdapterSuite) TestAcceptEncodingNegotiation() {
+	as.restartServer(WithCompressMinSize("0"))
+
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"gzip;q=0", ""},
+		{"gzip;q=0, br;q=0.5", "br"},
+		{"gzip, br;q=0.9, zstd;q=0.8", "gzip"},
+		{"gzip, br, zstd", "zstd"},
+		{"*;q=0.1, zstd;q=0", "br"},
+		{"identity", ""},
+		{"GZIP; Q=0.3", "gzip"},
+	}
+
+	for _, t := range tests {
+		resp := as.cli.PostAccepting("/api/shorten", t.acceptEncoding, `{"url": "https://pkg.go.dev/cmp"}`)
+		resp.Body.Close()
+
+		as.Equal(t.expected, resp.Header.Get("Content-Encoding"), "Content encoding for "+t.acceptEncoding)
+	}
+}
+
+func (as *AdapterSuite) TestSmallResponsesAreNotCompressed() {
+	resp := as.cli.PostAcceptingGzip("/api/shorten", `{"url": "https://pkg.go.dev/cmp"}`)
+	defer resp.Body.Close()
+
+	as.Equal(http.StatusCreated, resp.StatusCode, "Response status code")
+	as.Empty(resp.Header.Get("Content-Encoding"), "Content encoding")
+	as.Equal("Accept-Encoding", resp.Header.Get("Vary"), "Vary")
+
+	key := as.cli.extractKeyAPI(DefaultBaseURL, as.cli.readBody(resp.Body))
+	resp = as.cli.GetWithHeader("/"+key, http.Header{"Accept-Encoding": {"gzip"}})
+	defer resp.Body.Close()
+
+	as.Equal(http.StatusTemporaryRedirect, resp.StatusCode, "Response status code")
+	as.Empty(resp.Header.Get("Content-Encoding"), "Content encoding of the redirect")
+}
+
+func (as *AdapterSuite) TestLargeResponsesAreCompressed() {
+	resp := as.cli.GetWithHeader("/metrics", http.Header{"Accept-Encoding": {"gzip"}})
+	defer resp.Body.Close()
+
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+	as.Equal("gzip", resp.Header.Get("Content-Encoding"), "Content encoding")
+	as.Equal("Accept-Encoding", resp.Header.Get("Vary"), "Vary")
+
+	gz, err := gzip.NewReader(resp.Body)
+	as.Require().NoError(err)
+	as.Contains(as.cli.readBody(gz), "shorturl_", "Decompressed body")
+}
+
 func (as *AdapterSuite) TestSendingGzip() {
 	resp := as.cli.PostGzippedJSON("/api/shorten", `{"url": "https://pkg.go.dev/cmp"}`)
 	defer resp.Body.Close()
@@ -94,3 +227,798 @@ func (as *AdapterSuite) TestSendingGzip() {
 	body := as.cli.readBody(resp.Body)
 	as.Contains(body, DefaultBaseURL, "body")
 }
+
+func (as *AdapterSuite) TestSendingOtherEncodings() {
+	for _, encoding := range []string{"deflate", "br", "zstd", "gzip, br", "identity, x-gzip"} {
+		body := encodeBody(as.T(), encoding, []byte(`{"url": "https://pkg.go.dev/cmp"}`))
+		resp := as.cli.PostEncoded("/api/shorten", encoding, body)
+		resp.Body.Close()
+
+		as.Contains([]int{http.StatusCreated, http.StatusConflict}, resp.StatusCode, "Response status code for "+encoding)
+	}
+}
+
+func (as *AdapterSuite) TestUnsupportedEncoding() {
+	resp := as.cli.PostEncoded("/api/shorten", "compress", []byte(`{"url": "https://pkg.go.dev/cmp"}`))
+	defer resp.Body.Close()
+
+	as.Equal(http.StatusUnsupportedMediaType, resp.StatusCode, "Response status code")
+}
+
+func (as *AdapterSuite) TestDecompressionBomb() {
+	as.restartServer(WithMaxDecompressedBodySize("1000000"))
+
+	tests := []struct {
+		query string
+		body  []byte
+	}{
+		{"/", bytes.Repeat([]byte("a"), 2_000_000)},
+		{"/api/shorten", bytes.Repeat([]byte(" "), 2_000_000)},
+		{"/api/shorten/batch", bytes.Repeat([]byte(" "), 2_000_000)},
+	}
+
+	for _, t := range tests {
+		for _, encoding := range []string{"gzip", "zstd", "br, gzip"} {
+			bomb := encodeBody(as.T(), encoding, t.body)
+			as.Less(len(bomb), 100_000, "Compressed size")
+
+			resp := as.cli.PostEncoded(t.query, encoding, bomb)
+			defer resp.Body.Close()
+
+			as.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode, "Response status code for %s %s", encoding, t.query)
+			as.Contains(as.cli.readBody(resp.Body), "limit is 1000000 bytes", "Error")
+		}
+	}
+}
+
+func (as *AdapterSuite) TestTooLargeBody() {
+	as.restartServer(WithMaxBodySize("100"))
+
+	resp := as.cli.POST("", "text/plain", "https://pkg.go.dev/"+strings.Repeat("a", 100))
+	defer resp.Body.Close()
+
+	as.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode, "Response status code")
+
+	as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+}
+
+func (as *AdapterSuite) TestTooManyEncodings() {
+	encoding := "gzip, gzip, gzip, gzip"
+	resp := as.cli.PostEncoded("/api/shorten", encoding, encodeBody(as.T(), encoding, []byte(`{"url": "https://pkg.go.dev/cmp"}`)))
+	defer resp.Body.Close()
+
+	as.Equal(http.StatusBadRequest, resp.StatusCode, "Response status code")
+}
+
+// encodeBody applies the content codings in the order they are listed.
+func encodeBody(t *testing.T, contentEncoding string, data []byte) []byte {
+	for _, coding := range contentEncodings([]string{contentEncoding}) {
+		var b bytes.Buffer
+		var w io.WriteCloser
+		switch coding {
+		case "gzip":
+			w = gzip.NewWriter(&b)
+		case "deflate":
+			w = zlib.NewWriter(&b)
+		case "br":
+			w = brotli.NewWriter(&b)
+		case "zstd":
+			zw, err := zstd.NewWriter(&b)
+			require.NoError(t, err)
+			w = zw
+		default:
+			t.Fatalf("unknown coding %s", coding)
+		}
+
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		data = b.Bytes()
+	}
+	return data
+}
+
+func (as *AdapterSuite) TestShortenRateLimit() {
+	as.restartServer(WithShortenRateLimit("2/m"))
+
+	for i, remaining := range []string{"1", "0"} {
+		resp := as.cli.POST("", "text/plain", fmt.Sprintf("https://pkg.go.dev/limited%d", i))
+		resp.Body.Close()
+
+		as.Equal(http.StatusCreated, resp.StatusCode, "Response status code")
+		as.Equal("2", resp.Header.Get("RateLimit-Limit"), "RateLimit-Limit")
+		as.Equal(remaining, resp.Header.Get("RateLimit-Remaining"), "RateLimit-Remaining")
+	}
+
+	resp := as.cli.PostJSON("/api/shorten/batch", BatchRequest{})
+	defer resp.Body.Close()
+
+	as.Equal(http.StatusTooManyRequests, resp.StatusCode, "Response status code")
+	as.Equal("30", resp.Header.Get("Retry-After"), "Retry-After")
+	as.Equal("60", resp.Header.Get("RateLimit-Reset"), "RateLimit-Reset")
+
+	as.cli.LookUpNotFound("unknown")
+}
+
+func (as *AdapterSuite) TestRedirectRateLimit() {
+	as.restartServer(WithRedirectRateLimit("1/s"))
+
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+	as.cli.LookUp(key)
+	as.cli.Redirect(key, http.StatusTooManyRequests)
+	resp := as.cli.GET("/" + key + "/qr")
+	resp.Body.Close()
+	as.Equal(http.StatusTooManyRequests, resp.StatusCode, "Response status code of a QR code")
+
+	as.cli.Shorten("https://pkg.go.dev/time", DefaultBaseURL)
+}
+
+func (as *AdapterSuite) TestRateLimitBehindTrustedProxy() {
+	as.restartServer(WithTrustedProxies("127.0.0.1, ::1"), WithRedirectRateLimit("1/m"))
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+
+	for _, client := range []string{"198.51.100.1", "198.51.100.2"} {
+		resp := as.cli.GetWithHeader("/"+key, http.Header{"X-Forwarded-For": {client}})
+		resp.Body.Close()
+		as.Equal(http.StatusTemporaryRedirect, resp.StatusCode, "Response status code for "+client)
+	}
+
+	resp := as.cli.GetWithHeader("/"+key, http.Header{"Forwarded": {"for=198.51.100.1"}})
+	resp.Body.Close()
+	as.Equal(http.StatusTooManyRequests, resp.StatusCode, "Response status code of the second request")
+}
+
+func (as *AdapterSuite) TestRateLimitOfAdmin() {
+	as.restartServer(WithRedirectRateLimit("1/m"), WithAdminToken("secret"))
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+
+	as.cli.LookUp(key)
+	as.cli.Redirect(key, http.StatusTooManyRequests)
+
+	tests := map[string]int{
+		"Bearer secret": http.StatusTemporaryRedirect,
+		"Bearer wrong":  http.StatusTooManyRequests,
+	}
+	for auth, expected := range tests {
+		resp := as.cli.GetWithHeader("/"+key, http.Header{"Authorization": {auth}})
+		resp.Body.Close()
+		as.Equal(expected, resp.StatusCode, "Response status code with "+auth)
+	}
+}
+
+func (as *AdapterSuite) TestInvalidURLs() {
+	resp := as.cli.ShortenRejected("javascript:alert(1)")
+	as.Equal(ReasonSchemeNotAllowed, resp.Reason, "Reason")
+	as.Contains(resp.Error, "javascript", "Error")
+
+	as.Equal(ReasonNotAbsolute, as.cli.ShortenRejected("pkg.go.dev/cmp").Reason, "Reason")
+	as.Equal(ReasonEmpty, as.cli.ShortenRejected("").Reason, "Reason")
+
+	textResp := as.cli.POST("", "text/plain", "garbage")
+	defer textResp.Body.Close()
+	as.Equal(http.StatusBadRequest, textResp.StatusCode, "Response status code")
+	as.Contains(as.cli.readBody(textResp.Body), ReasonNotAbsolute, "Error")
+
+	batch := as.cli.PostJSON("/api/shorten/batch", BatchRequest{{CorrelationID: "1", OriginalURL: "ftp://example.com"}})
+	defer batch.Body.Close()
+	as.Equal(http.StatusBadRequest, batch.StatusCode, "Response status code")
+	as.Contains(as.cli.readBody(batch.Body), `"reason":"scheme_not_allowed"`, "Batch error")
+}
+
+func (as *AdapterSuite) TestNormalizedURL() {
+	key := as.cli.Shorten("HTTPS://PKG.go.dev:443/%63mp", DefaultBaseURL)
+
+	as.Equal("https://pkg.go.dev/cmp", as.cli.LookUp(key), "Stored URL")
+}
+
+func (as *AdapterSuite) TestDomainPolicy() {
+	dir := as.T().TempDir()
+	policy := filepath.Join(dir, "policy")
+	as.Require().NoError(os.WriteFile(policy, []byte("deny evil.example\n"), 0666))
+	as.restartServer(WithDomainPolicy(policy), WithStoragePath(filepath.Join(dir, "urls.json")))
+
+	as.Equal(ReasonDomainNotAllowed, as.cli.ShortenRejected("https://evil.example/login").Reason, "Reason")
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+	as.cli.LookUp(key)
+	permanent := as.cli.ShortenWithOptions(ShortURLRequest{
+		URL:         "https://pkg.go.dev/time",
+		LinkOptions: LinkOptions{RedirectType: http.StatusMovedPermanently},
+	}, DefaultBaseURL)
+	header := as.cli.Redirect(permanent, http.StatusMovedPermanently)
+	as.Equal("public, max-age=300", header.Get("Cache-Control"), "Cache control of a permanent redirect")
+
+	as.Require().NoError(os.WriteFile(policy, []byte("deny *.go.dev\n"), 0666))
+	as.restartServer(WithDomainPolicy(policy), WithStoragePath(filepath.Join(dir, "urls.json")))
+
+	as.cli.Redirect(key, http.StatusForbidden)
+}
+
+func (as *AdapterSuite) TestThreatList() {
+	dir := as.T().TempDir()
+	threats := filepath.Join(dir, "threats")
+	as.Require().NoError(os.WriteFile(threats, []byte("evil.example\n"), 0666))
+	as.restartServer(WithThreatList(threats), WithStoragePath(filepath.Join(dir, "urls.json")),
+		WithAdminToken("secret"))
+
+	as.Equal(ReasonMalicious, as.cli.ShortenRejected("https://www.evil.example/login").Reason, "Reason")
+	key := as.cli.Shorten("https://pkg.go.dev/<script>", DefaultBaseURL)
+	protected := as.cli.ShortenWithOptions(ShortURLRequest{
+		URL:         "https://pkg.go.dev/secret",
+		LinkOptions: LinkOptions{Password: "secret"},
+	}, DefaultBaseURL)
+
+	as.Require().NoError(os.WriteFile(threats, []byte("pkg.go.dev/\n"), 0666))
+	as.restartServer(WithThreatList(threats), WithStoragePath(filepath.Join(dir, "urls.json")),
+		WithAdminToken("secret"))
+
+	resp := as.cli.GET("/" + key)
+	defer resp.Body.Close()
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+	body := as.cli.readBody(resp.Body)
+	as.Contains(body, "may be harmful", "Warning page")
+	as.Contains(body, "https://pkg.go.dev/%3Cscript%3E", "Escaped destination")
+	as.NotContains(body, "<script>", "Escaped destination")
+
+	resp = as.cli.GET("/" + protected)
+	defer resp.Body.Close()
+	as.Contains(as.cli.readBody(resp.Body), `type="password"`, "Password form of a flagged link")
+	resp = as.cli.PostForm("/"+protected, url.Values{"password": {"secret"}})
+	defer resp.Body.Close()
+	as.Contains(as.cli.readBody(resp.Body), "https://pkg.go.dev/secret", "Warning page after the password")
+
+	resp = as.cli.GET("/api/admin/flagged")
+	resp.Body.Close()
+	as.Equal(http.StatusUnauthorized, resp.StatusCode, "Response status code without the token")
+
+	resp = as.cli.GetWithHeader("/api/admin/flagged", http.Header{"Authorization": {"Bearer secret"}})
+	defer resp.Body.Close()
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+	var flagged []FlaggedLink
+	as.Require().NoError(json.NewDecoder(resp.Body).Decode(&flagged))
+	as.Equal([]FlaggedLink{
+		{DefaultBaseURL + "/" + key, "https://pkg.go.dev/%3Cscript%3E"},
+		{DefaultBaseURL + "/" + protected, "https://pkg.go.dev/secret"},
+	}, flagged)
+}
+
+func (as *AdapterSuite) TestPreview() {
+	const url = "https://pkg.go.dev/search?q=<script>alert(1)</script>"
+	key := as.cli.Shorten(url, DefaultBaseURL)
+
+	for _, query := range []string{"/" + key + "+", "/" + key + "?preview=1"} {
+		resp := as.cli.GET(query)
+		body := as.cli.readBody(resp.Body)
+		resp.Body.Close()
+		as.Equal(http.StatusOK, resp.StatusCode, "Response status code of %s", query)
+		as.Empty(resp.Header.Get("Location"), "Location of %s", query)
+		as.Contains(body, "https://pkg.go.dev/search?q=&lt;script&gt;alert(1)&lt;/script&gt;", "Escaped destination")
+		as.NotContains(body, "<script>", "Escaped destination")
+		as.Contains(body, time.Now().UTC().Format(time.DateOnly), "Creation date")
+	}
+
+	resp := as.cli.GET("/zzzzzz+")
+	resp.Body.Close()
+	as.Equal(http.StatusNotFound, resp.StatusCode, "Response status code of a missing key")
+}
+
+func (as *AdapterSuite) TestPreviewOfProtectedLink() {
+	req := ShortURLRequest{
+		URL:         "https://pkg.go.dev/crypto",
+		LinkOptions: LinkOptions{Password: "secret", MaxClicks: 1},
+	}
+	key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+
+	resp := as.cli.GET("/" + key + "+")
+	body := as.cli.readBody(resp.Body)
+	resp.Body.Close()
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+	as.Contains(body, "password protected", "Preview")
+	as.NotContains(body, req.URL, "Hidden destination")
+
+	as.Equal(req.URL, as.cli.Unlock(key, "secret", http.StatusSeeOther), "The preview consumes no clicks")
+}
+
+func (as *AdapterSuite) TestCustomPreviewTemplate() {
+	dir := as.T().TempDir()
+	tmpl := `<a href="{{.OriginalURL}}">{{.OriginalURL}}</a> clicked {{.Clicks}} times`
+	as.Require().NoError(os.WriteFile(filepath.Join(dir, "preview.html"), []byte(tmpl), 0666))
+	as.restartServer(WithTemplatesDir(dir))
+
+	key := as.cli.Shorten(`https://pkg.go.dev/search?q="x"`, DefaultBaseURL)
+	resp := as.cli.GET("/" + key + "+")
+	defer resp.Body.Close()
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+	as.Equal(`<a href="https://pkg.go.dev/search?q=%22x%22">https://pkg.go.dev/search?q=&#34;x&#34;</a> clicked 0 times`,
+		as.cli.readBody(resp.Body))
+}
+
+func (as *AdapterSuite) TestQRCode() {
+	key := as.cli.Shorten("https://pkg.go.dev/image", DefaultBaseURL)
+	want, _, err := qrImage(DefaultBaseURL+"/"+key, qrOptions{defaultQRSize, qrcode.Medium, "png"})
+	as.Require().NoError(err)
+
+	resp := as.cli.GET("/" + key + "/qr")
+	body := as.cli.readBody(resp.Body)
+	resp.Body.Close()
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+	as.Equal("image/png", resp.Header.Get("Content-Type"), "Content type")
+	as.Equal("public, max-age=86400", resp.Header.Get("Cache-Control"), "Cache control")
+	as.Equal(string(want), body, "Image")
+
+	etag := resp.Header.Get("ETag")
+	as.NotEmpty(etag, "ETag")
+	resp = as.cli.GetWithHeader("/"+key+"/qr", http.Header{"If-None-Match": {etag}})
+	resp.Body.Close()
+	as.Equal(http.StatusNotModified, resp.StatusCode, "Response status code of a cached image")
+
+	resp = as.cli.GET("/" + key + "/qr?format=svg&size=512&level=H")
+	body = as.cli.readBody(resp.Body)
+	resp.Body.Close()
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+	as.Equal("image/svg+xml", resp.Header.Get("Content-Type"), "Content type")
+	as.True(strings.HasPrefix(body, "<svg"), "SVG image")
+
+	resp = as.cli.GET("/" + key + "/qr?size=5000")
+	resp.Body.Close()
+	as.Equal(http.StatusBadRequest, resp.StatusCode, "Response status code of an invalid size")
+
+	resp = as.cli.GET("/zzzzzz/qr")
+	resp.Body.Close()
+	as.Equal(http.StatusNotFound, resp.StatusCode, "Response status code of a missing key")
+}
+
+func (as *AdapterSuite) TestShortenWithQRCode() {
+	resp := as.cli.PostJSON("/api/shorten", ShortURLRequest{URL: "https://pkg.go.dev/image", QR: true})
+	defer resp.Body.Close()
+	as.Equal(http.StatusCreated, resp.StatusCode, "Response status code")
+
+	var sr ShortURLResponse
+	as.Require().NoError(json.NewDecoder(resp.Body).Decode(&sr))
+	as.Equal(sr.Result+"/qr", sr.QR, "QR code address")
+}
+
+func (as *AdapterSuite) TestShortenInvalidURLWithQRCode() {
+	resp := as.cli.PostJSON("/api/shorten", ShortURLRequest{URL: "javascript:alert(1)", QR: true})
+	defer resp.Body.Close()
+	as.Equal(http.StatusBadRequest, resp.StatusCode, "Response status code")
+	as.NotContains(as.cli.readBody(resp.Body), `"qr"`, "QR code address of a rejected URL")
+}
+
+func (as *AdapterSuite) TestQRCodeOfPassthroughLink() {
+	req := ShortURLRequest{URL: "https://pkg.go.dev", LinkOptions: LinkOptions{Passthrough: true}}
+	key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+
+	resp := as.cli.GET("/" + key + "/qr")
+	resp.Body.Close()
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+	as.Equal("image/png", resp.Header.Get("Content-Type"), "QR code rather than a passed through path")
+}
+
+func (as *AdapterSuite) TestExpiringLink() {
+	req := ShortURLRequest{
+		URL:         "https://pkg.go.dev/time",
+		LinkOptions: LinkOptions{ExpiresAt: time.Now().Add(200 * time.Millisecond)},
+	}
+	key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+	as.Equal(req.URL, as.cli.LookUp(key))
+
+	time.Sleep(300 * time.Millisecond)
+	as.cli.LookUpGone(key)
+}
+
+func (as *AdapterSuite) TestInvalidExpiration() {
+	const url = "https://pkg.go.dev/time"
+	past := time.Now().Add(-time.Minute)
+
+	as.cli.ShortenInvalidOptions(ShortURLRequest{URL: url, LinkOptions: LinkOptions{TTL: -1}})
+	as.cli.ShortenInvalidOptions(ShortURLRequest{URL: url, LinkOptions: LinkOptions{ExpiresAt: past}})
+	as.cli.ShortenInvalidOptions(ShortURLRequest{URL: url, LinkOptions: LinkOptions{
+		TTL: 60, ExpiresAt: time.Now().Add(time.Hour),
+	}})
+}
+
+func (as *AdapterSuite) TestClickLimitUnderConcurrentRedirects() {
+	const maxClicks, redirects = 5, 50
+	req := ShortURLRequest{URL: "https://pkg.go.dev/sync", LinkOptions: LinkOptions{MaxClicks: maxClicks}}
+	key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+
+	var redirected, gone atomic.Int32
+	var wg sync.WaitGroup
+	for range redirects {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := as.cli.GET("/" + key)
+			resp.Body.Close()
+
+			switch resp.StatusCode {
+			case http.StatusTemporaryRedirect:
+				redirected.Add(1)
+			case http.StatusGone:
+				gone.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	as.EqualValues(maxClicks, redirected.Load(), "redirects")
+	as.EqualValues(redirects-maxClicks, gone.Load(), "exhausted redirects")
+	as.cli.LookUpGone(key)
+
+	resp := as.cli.GET("/" + key + "/qr")
+	resp.Body.Close()
+	as.Equal(http.StatusGone, resp.StatusCode, "Response status code of a QR code of an exhausted link")
+}
+
+func (as *AdapterSuite) TestRefusedRequestsKeepClicks() {
+	req := ShortURLRequest{URL: "https://pkg.go.dev/sync", LinkOptions: LinkOptions{MaxClicks: 1}}
+	key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+
+	for range 3 {
+		resp := as.cli.GET("/" + key + "/junk")
+		resp.Body.Close()
+		as.Equal(http.StatusNotFound, resp.StatusCode, "Path of a link without passthrough")
+	}
+	as.Equal(req.URL, as.cli.LookUp(key))
+	as.cli.LookUpGone(key)
+}
+
+func (as *AdapterSuite) TestPasswordProtectedLink() {
+	req := ShortURLRequest{
+		URL:         "https://pkg.go.dev/crypto",
+		LinkOptions: LinkOptions{Password: "secret", MaxClicks: 1},
+	}
+	key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+
+	resp := as.cli.GET("/" + key)
+	body := as.cli.readBody(resp.Body)
+	resp.Body.Close()
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+	as.Contains(body, `type="password"`, "password form")
+
+	as.cli.Unlock(key, "wrong", http.StatusForbidden)
+	as.Equal(req.URL, as.cli.Unlock(key, "secret", http.StatusSeeOther))
+	as.cli.Unlock(key, "secret", http.StatusGone)
+}
+
+func (as *AdapterSuite) TestPasswordAttemptsLimit() {
+	req := ShortURLRequest{
+		URL:         "https://pkg.go.dev/crypto",
+		LinkOptions: LinkOptions{Password: "secret"},
+	}
+	key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+
+	for range maxPasswordFailures {
+		as.cli.Unlock(key, "wrong", http.StatusForbidden)
+	}
+	as.cli.Unlock(key, "secret", http.StatusTooManyRequests)
+}
+
+func (as *AdapterSuite) TestRedirectType() {
+	const url = "https://pkg.go.dev/net/http"
+	tests := []struct {
+		redirectType, expected int
+		cacheControl           string
+	}{
+		{0, http.StatusTemporaryRedirect, "private, no-cache"},
+		{http.StatusFound, http.StatusFound, "private, no-cache"},
+		{http.StatusMovedPermanently, http.StatusMovedPermanently, "public, max-age=31536000"},
+		{http.StatusPermanentRedirect, http.StatusPermanentRedirect, "public, max-age=31536000"},
+	}
+
+	for _, t := range tests {
+		req := ShortURLRequest{URL: url, LinkOptions: LinkOptions{RedirectType: t.redirectType}}
+		key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+
+		header := as.cli.Redirect(key, t.expected)
+		as.Equal(url, header.Get("Location"))
+		as.Equal(t.cacheControl, header.Get("Cache-Control"))
+	}
+
+	as.cli.ShortenInvalidOptions(ShortURLRequest{URL: url, LinkOptions: LinkOptions{RedirectType: 200}})
+}
+
+func (as *AdapterSuite) TestDefaultRedirectType() {
+	as.restartServer(WithRedirectType("308"))
+
+	key := as.cli.Shorten("https://pkg.go.dev/net/http", DefaultBaseURL)
+	as.cli.Redirect(key, http.StatusPermanentRedirect)
+
+	req := ShortURLRequest{
+		URL:         "https://pkg.go.dev/time",
+		LinkOptions: LinkOptions{RedirectType: http.StatusFound},
+	}
+	key = as.cli.ShortenWithOptions(req, DefaultBaseURL)
+	as.cli.Redirect(key, http.StatusFound)
+}
+
+func (as *AdapterSuite) TestPermanentRedirectOfExpiringLink() {
+	req := ShortURLRequest{
+		URL:         "https://pkg.go.dev/time",
+		LinkOptions: LinkOptions{RedirectType: http.StatusMovedPermanently, TTL: 60},
+	}
+	key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+
+	header := as.cli.Redirect(key, http.StatusMovedPermanently)
+	as.Regexp(`^public, max-age=(59|60)$`, header.Get("Cache-Control"))
+}
+
+func (as *AdapterSuite) TestPassthrough() {
+	req := ShortURLRequest{
+		URL:         "https://example.com/docs?lang=en",
+		LinkOptions: LinkOptions{Passthrough: true},
+	}
+	key := as.cli.ShortenWithOptions(req, DefaultBaseURL)
+
+	tests := []struct {
+		suffix, expected string
+	}{
+		{"", "https://example.com/docs?lang=en"},
+		{"?utm_source=x", "https://example.com/docs?lang=en&utm_source=x"},
+		{"?lang=fr&utm_source=x", "https://example.com/docs?lang=en&utm_source=x"},
+		{"/a/b?utm_source=x", "https://example.com/docs/a/b?lang=en&utm_source=x"},
+		{"/a/b/", "https://example.com/docs/a/b/?lang=en"},
+		{"/a/../../../etc", "https://example.com/docs/etc?lang=en"},
+	}
+
+	for _, t := range tests {
+		header := as.cli.Redirect(key+t.suffix, http.StatusTemporaryRedirect)
+		as.Equal(t.expected, header.Get("Location"), t.suffix)
+	}
+}
+
+func (as *AdapterSuite) TestNoPassthrough() {
+	const url = "https://example.com/docs?lang=en"
+	key := as.cli.Shorten(url, DefaultBaseURL)
+
+	header := as.cli.Redirect(key+"?utm_source=x", http.StatusTemporaryRedirect)
+	as.Equal(url, header.Get("Location"))
+
+	as.cli.LookUpNotFound(key + "/a/b")
+}
+
+func (as *AdapterSuite) TestClickStats() {
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+	as.Equal(ClickStats{Key: key, Daily: []DailyClicks{}}, as.cli.Stats(key))
+
+	const clicks = 3
+	for range clicks {
+		as.cli.LookUp(key)
+	}
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	expected := ClickStats{Key: key, Total: clicks, Visitors: 1,
+		Daily: []DailyClicks{{Date: today, Clicks: clicks, Visitors: 1}}}
+	as.Eventually(func() bool {
+		return assert.ObjectsAreEqual(expected, as.cli.Stats(key))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (as *AdapterSuite) TestClickStatsNotFound() {
+	resp := as.cli.GET("/api/urls/unknown/stats")
+	defer resp.Body.Close()
+
+	as.Equal(http.StatusNotFound, resp.StatusCode, "Response status code")
+}
+
+func (as *AdapterSuite) TestMetrics() {
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+	as.cli.LookUp(key)
+	as.cli.LookUpNotFound("unknown")
+
+	resp := as.cli.GET("/metrics")
+	defer resp.Body.Close()
+	as.Equal(http.StatusOK, resp.StatusCode, "Response status code")
+
+	body := as.cli.readBody(resp.Body)
+	as.Contains(body, `shorturl_http_requests_total{method="POST",route="/",status="201"} 1`)
+	as.Contains(body, `shorturl_http_requests_total{method="GET",route="/{key}",status="307"} 1`)
+	as.Contains(body, `shorturl_http_request_duration_seconds_count{method="GET",route="/{key}"} 2`)
+	as.Contains(body, `shorturl_redirects_total{result="hit"} 1`)
+	as.Contains(body, `shorturl_redirects_total{result="miss"} 1`)
+	as.Contains(body, `shorturl_keygen_position 1`)
+}
+
+func (as *AdapterSuite) TestTracing() {
+	sr := tracetest.NewSpanRecorder()
+	as.restartServer(WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))))
+
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	header := http.Header{"Traceparent": {"00-" + traceID + "-00f067aa0ba902b7-01"}}
+	resp := as.cli.GetWithHeader("/"+key, header)
+	resp.Body.Close()
+	as.Equal(http.StatusTemporaryRedirect, resp.StatusCode, "Response status code")
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range sr.Ended() {
+		if s.SpanContext().TraceID().String() == traceID {
+			spans[s.Name()] = s
+		}
+	}
+	as.Require().Contains(spans, "GET /{key}")
+	as.Require().Contains(spans, "service.LookUp")
+	as.Require().Contains(spans, "storage.Peek")
+
+	server := spans["GET /{key}"]
+	as.Equal("00f067aa0ba902b7", server.Parent().SpanID().String(), "Remote parent of the server span")
+	as.Equal(server.SpanContext().SpanID(), spans["service.LookUp"].Parent().SpanID(), "Parent of the service span")
+	as.Equal(spans["service.LookUp"].SpanContext().SpanID(), spans["storage.Peek"].Parent().SpanID(),
+		"Parent of the storage span")
+}
+
+func (as *AdapterSuite) TestTracingFileWrites() {
+	sr := tracetest.NewSpanRecorder()
+	as.restartServer(WithStoragePath(filepath.Join(as.T().TempDir(), "urls.json")),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))))
+
+	as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+
+	find := func(name string) sdktrace.ReadOnlySpan {
+		for _, s := range sr.Ended() {
+			if s.Name() == name {
+				return s
+			}
+		}
+		return nil
+	}
+	as.Eventually(func() bool { return find("fileStorage.write") != nil },
+		time.Second, 10*time.Millisecond, "file write span")
+
+	write, store := find("fileStorage.write"), find("storage.Store")
+	as.Require().NotNil(store)
+	as.Equal(store.SpanContext().TraceID(), write.SpanContext().TraceID(), "Trace of the file write")
+	as.Equal(store.SpanContext().SpanID(), write.Parent().SpanID(), "Parent of the file write span")
+}
+
+func (as *AdapterSuite) TestRequestID() {
+	log := &recordingLogger{entries: &[]string{}, mu: &sync.Mutex{}}
+	as.restartServer(WithLogger(log))
+
+	resp := as.cli.GetWithHeader("/ping", http.Header{"X-Request-Id": {"req-42"}})
+	resp.Body.Close()
+	as.Equal("req-42", resp.Header.Get("X-Request-ID"), "Echoed request ID")
+	as.Eventually(func() bool {
+		return slices.ContainsFunc(log.all(), func(e string) bool {
+			return strings.HasPrefix(e, "request request_id=req-42 uri=/ping method=GET status=200 ") &&
+				strings.HasSuffix(e, " remote_ip=127.0.0.1 scheme=http")
+		})
+	}, time.Second, 10*time.Millisecond, "Access log entry with the request ID")
+
+	resp = as.cli.GetWithHeader("/ping", http.Header{"X-Request-Id": {"bad id"}})
+	resp.Body.Close()
+	generated := resp.Header.Get("X-Request-ID")
+	as.NotEmpty(generated, "Generated request ID")
+	as.NotEqual("bad id", generated, "Invalid request ID replaced")
+
+	resp = as.cli.GET("/ping")
+	resp.Body.Close()
+	as.NotEqual(generated, resp.Header.Get("X-Request-ID"), "Request IDs are unique")
+}
+
+func (as *AdapterSuite) TestCombinedAccessLog() {
+	path := filepath.Join(as.T().TempDir(), "access.log")
+	as.restartServer(WithAccessLogFormat("combined"), WithAccessLogPath(path))
+
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+	header := http.Header{"Referer": {"https://example.com/"}, "User-Agent": {`curl "8"`}}
+	resp := as.cli.GetWithHeader("/"+key, header)
+	resp.Body.Close()
+
+	pattern := regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] ` +
+		`"GET /` + key + ` HTTP/1\.1" 307 \d+ "https://example.com/" "curl \\"8\\""$`)
+	as.Eventually(func() bool {
+		return slices.ContainsFunc(readLines(path), pattern.MatchString)
+	}, time.Second, 10*time.Millisecond, "Access log entry in the combined format")
+}
+
+func (as *AdapterSuite) TestAccessLogSampling() {
+	path := filepath.Join(as.T().TempDir(), "access.log")
+	as.restartServer(WithAccessLogPath(path), WithAccessLogSample("2"))
+
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+	for range 4 {
+		as.cli.LookUp(key)
+	}
+	as.cli.LookUpNotFound("unknown")
+
+	count := func(status string) int {
+		n := 0
+		for _, line := range readLines(path) {
+			if strings.Contains(line, `"status":`+status) {
+				n++
+			}
+		}
+		return n
+	}
+	as.Eventually(func() bool {
+		return count("201") == 1 && count("404") == 1 && count("307") == 2
+	}, time.Second, 10*time.Millisecond, "Every second redirect logged")
+}
+
+func (as *AdapterSuite) TestBloomFilter() {
+	as.restartServer(WithBloomFPRate("0.01"))
+
+	key := as.cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+	as.Equal("https://pkg.go.dev/cmp", as.cli.LookUp(key))
+	as.cli.LookUpNotFound("unknown")
+
+	resp := as.cli.GET("/metrics")
+	defer resp.Body.Close()
+	as.Contains(as.cli.readBody(resp.Body), "shorturl_bloom_rejected_lookups_total 1")
+}
+
+func (as *AdapterSuite) TestHealthz() {
+	as.Equal(Health{Status: "ok"}, as.cli.Health("/healthz", http.StatusOK))
+}
+
+func (as *AdapterSuite) TestReadyz() {
+	as.restartServer(WithStoragePath(filepath.Join(as.T().TempDir(), "urls.json")))
+
+	expected := Health{Status: "ok", Checks: map[string]HealthCheck{
+		"storage":     {Status: "ok"},
+		"file_writer": {Status: "ok"},
+		"draining":    {Status: "ok"},
+	}}
+	as.Equal(expected, as.cli.Health("/readyz", http.StatusOK))
+}
+
+func (as *AdapterSuite) TestReadyzWhileDraining() {
+	as.adp.drain()
+
+	h := as.cli.Health("/readyz", http.StatusServiceUnavailable)
+	as.Equal("fail", h.Status)
+	as.Equal(HealthCheck{Status: "fail", Error: "server is shutting down"}, h.Checks["draining"])
+	as.Equal(HealthCheck{Status: "ok"}, h.Checks["storage"])
+
+	as.Equal(Health{Status: "ok"}, as.cli.Health("/healthz", http.StatusOK), "Alive while draining")
+}
+
+func readLines(path string) []string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+type recordingLogger struct {
+	mu      *sync.Mutex
+	entries *[]string
+	fields  []any
+}
+
+func (rl recordingLogger) Debug(msg string, v ...any) {
+	rl.Info(msg, v...)
+}
+
+func (rl recordingLogger) Info(msg string, v ...any) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	entry := fmt.Sprintf(msg, v...)
+	for i := 0; i+1 < len(rl.fields); i += 2 {
+		entry += fmt.Sprintf(" %v=%v", rl.fields[i], rl.fields[i+1])
+	}
+	*rl.entries = append(*rl.entries, entry)
+}
+
+func (rl recordingLogger) Warn(msg string, v ...any) {
+	rl.Info(msg, v...)
+}
+
+func (rl recordingLogger) Error(err error, msg string, v ...any) {
+	rl.Info(msg+": error "+err.Error(), v...)
+}
+
+func (rl recordingLogger) With(kv ...any) logger {
+	return recordingLogger{rl.mu, rl.entries, append(slices.Clip(rl.fields), kv...)}
+}
+
+func (rl recordingLogger) all() []string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return slices.Clone(*rl.entries)
+}
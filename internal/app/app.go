@@ -1,18 +1,98 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 )
 
-var NewServer = func(modifiers ...Configurator) (*http.Server, error) {
+// Server drains the traffic before it shuts down, see Shutdown.
+type Server struct {
+	*http.Server
+	adp   adapter
+	grace time.Duration
+	// release the resources in order once the requests are completed
+	closers []func(context.Context) error
+}
+
+var NewServer = func(modifiers ...Configurator) (*Server, error) {
 	cfg, err := newConfig(modifiers...)
 	if err != nil {
 		return nil, err
 	}
+
+	var tracerShutdown func(context.Context) error
+	if cfg.traceExporter != "none" {
+		tp, err := newTracerProvider(cfg.traceExporter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the %s trace exporter: %w", cfg.traceExporter, err)
+		}
+		cfg.tracer, tracerShutdown = tp, tp.Shutdown
+	}
+
+	background, stop := context.WithCancel(context.Background())
+	cfg.background = background
 	a, err := newAdapter(cfg)
 	if err != nil {
+		stop()
+		if tracerShutdown != nil {
+			err = errors.Join(err, tracerShutdown(context.Background()))
+		}
 		return nil, err
 	}
 
-	return &http.Server{Addr: cfg.serverAddress, Handler: a.handler()}, nil
+	srv := &http.Server{Addr: cfg.serverAddress, Handler: a.handler()}
+
+	// the periodic jobs stop first, so that the final flush has the storage for itself
+	stopJobs := func(context.Context) error {
+		stop()
+		return nil
+	}
+	closers := []func(context.Context) error{stopJobs, a.svc.Flush, a.rateLimits.close, a.accessLog.close}
+	if tracerShutdown != nil {
+		closers = append(closers, tracerShutdown) // the last, to export the spans of the others
+	}
+
+	return &Server{srv, a, cfg.shutdownGracePeriod, closers}, nil
+}
+
+// ReopenLogs reopens the access log file, e.g. on SIGHUP after logrotate moved it away.
+func (s *Server) ReopenLogs() error {
+	return s.adp.accessLog.reopen()
+}
+
+// Shutdown fails the readiness probe and keeps serving for the grace period,
+// so that the load balancer stops routing new traffic here before the listeners are closed.
+// Then the in-flight requests are completed as by http.Server.Shutdown,
+// and the buffered data is flushed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.adp.drain()
+
+	select {
+	case <-time.After(s.grace):
+	case <-ctx.Done():
+	}
+
+	err := s.Server.Shutdown(ctx)
+	for _, c := range s.closers {
+		err = errors.Join(err, c(ctx))
+	}
+	return err
+}
+
+// every runs the job at the interval until the context is done.
+func every(ctx context.Context, interval time.Duration, job func(ctx context.Context, now time.Time)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			job(ctx, now)
+		}
+	}
 }
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestShutdownDrainsFirst(t *testing.T) {
+	srv, err := NewServer(WithLogger(testLogger{t: t}), WithMemoryStorage(), WithShutdownGracePeriod("300ms"))
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	readyz := "http://" + ln.Addr().String() + "/readyz"
+	status := func() int {
+		resp, err := http.Get(readyz)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, status(), "Ready before the shutdown")
+
+	shut := make(chan error, 1)
+	go func() { shut <- srv.Shutdown(context.Background()) }()
+
+	assert.Eventually(t, func() bool { return status() == http.StatusServiceUnavailable },
+		200*time.Millisecond, 10*time.Millisecond, "Draining reported during the grace period")
+	assert.NoError(t, <-shut)
+	assert.ErrorIs(t, <-served, http.ErrServerClosed)
+}
+
+func TestEveryStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var runs atomic.Int32
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		every(ctx, time.Millisecond, func(context.Context, time.Time) { runs.Add(1) })
+	}()
+
+	assert.Eventually(t, func() bool { return runs.Load() > 1 }, time.Second, time.Millisecond, "Periodic runs")
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("job still running after the context is done")
+	}
+}
+
+func TestShutdownFlushesOwnTracerProvider(t *testing.T) {
+	srv, err := NewServer(WithLogger(testLogger{t: t}), WithMemoryStorage(), WithShutdownGracePeriod("0s"),
+		WithTraceExporter("stdout"))
+	require.NoError(t, err)
+	assert.Len(t, srv.closers, 5, "Tracer provider shut down")
+	assert.NoError(t, srv.Shutdown(context.Background()))
+
+	srv, err = NewServer(WithLogger(testLogger{t: t}), WithMemoryStorage(), WithShutdownGracePeriod("0s"),
+		WithTraceExporter("stdout"), WithTracerProvider(sdktrace.NewTracerProvider()))
+	require.NoError(t, err)
+	assert.Len(t, srv.closers, 4, "Tracer provider of the caller left alone")
+
+	_, err = NewServer(WithLogger(testLogger{t: t}), WithMemoryStorage(), WithTraceExporter("jaeger"))
+	assert.ErrorContains(t, err, "invalid trace exporter jaeger")
+}
+
+func TestShutdownPersistsClicks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	srv, err := NewServer(WithLogger(testLogger{t: t}), WithDatabaseDsn(""), WithStoragePath(path),
+		WithShutdownGracePeriod("0s"))
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+
+	cli := NewClient(t)
+	cli.BaseURL = "http://" + ln.Addr().String()
+	key := cli.Shorten("https://pkg.go.dev/cmp", DefaultBaseURL)
+	cli.LookUp(key)
+	require.NoError(t, srv.Shutdown(context.Background()))
+
+	restored := newInMemStorage()
+	require.NoError(t, readClicksFile(restored, clicksPath(path)))
+	require.NoError(t, readVisitorsFile(restored, visitorsPath(path)))
+	daily, err := restored.ClickStats(context.Background(), key)
+	require.NoError(t, err)
+	require.Len(t, daily, 1, "Clicks")
+	assert.EqualValues(t, 1, daily[0].Clicks, "Clicks")
+	_, visitors, err := newVisitorCounter(t.Context(), restored, testLogger{t: t}).visitors(context.Background(), key)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, visitors, "Visitors")
+}
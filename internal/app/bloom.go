@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bloomStorage answers the lookups of the keys that were never stored without touching the storage.
+// The filter only learns the keys stored by this instance, so it must not be used
+// when several instances share the database.
+type bloomStorage struct {
+	storage
+	filter   *scalableBloomFilter
+	rejected *atomic.Int64
+}
+
+const bloomInitialCapacity = 1 << 20
+
+func newBloomStorage(ctx context.Context, st storage, cfg config) (bloomStorage, error) {
+	bs := bloomStorage{st, newScalableBloomFilter(bloomInitialCapacity, cfg.bloomFPRate), &atomic.Int64{}}
+
+	err := st.EachShortURL(ctx, bs.filter.add)
+	if err != nil {
+		return bs, fmt.Errorf("failed to load keys into the bloom filter: %w", err)
+	}
+
+	cfg.metrics.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bloom_rejected_lookups_total",
+		Help:      "Number of lookups of nonexistent keys answered by the bloom filter.",
+	}, func() float64 { return float64(bs.rejected.Load()) }))
+
+	return bs, nil
+}
+
+func (bs bloomStorage) Peek(ctx context.Context, shortURL string) (link, error) {
+	if !bs.filter.mayContain(shortURL) {
+		bs.rejected.Add(1)
+		return link{}, fmt.Errorf("%w: %s", errNotFound, shortURL)
+	}
+	return bs.storage.Peek(ctx, shortURL)
+}
+
+// Store adds the key to the filter first so that it can be looked up as soon as it is stored.
+func (bs bloomStorage) Store(ctx context.Context, l link) error {
+	bs.filter.add(l.shortURL)
+
+	return bs.storage.Store(ctx, l)
+}
+
+func (bs bloomStorage) StoreBatch(ctx context.Context, batch urlBatch) error {
+	for _, l := range batch {
+		bs.filter.add(l.shortURL)
+	}
+
+	return bs.storage.StoreBatch(ctx, batch)
+}
+
+// scalableBloomFilter adds a filter of twice the capacity and a tighter false positive rate
+// whenever the last one is full, so that the overall rate stays within the configured one
+// however many keys there are.
+type scalableBloomFilter struct {
+	mu      sync.RWMutex
+	filters []*bloomFilter
+	fpRate  float64
+}
+
+// The rates of the filters are fpRate/2, fpRate/4, ... adding up to at most fpRate.
+const bloomTighteningRatio = 0.5
+
+func newScalableBloomFilter(capacity int, fpRate float64) *scalableBloomFilter {
+	sbf := &scalableBloomFilter{fpRate: fpRate * (1 - bloomTighteningRatio)}
+	sbf.filters = []*bloomFilter{newBloomFilter(capacity, sbf.fpRate)}
+
+	return sbf
+}
+
+func (sbf *scalableBloomFilter) add(key string) {
+	h1, h2 := bloomHashes(key)
+
+	sbf.mu.Lock()
+	defer sbf.mu.Unlock()
+
+	last := sbf.filters[len(sbf.filters)-1]
+	if last.count >= last.capacity {
+		sbf.fpRate *= bloomTighteningRatio
+		last = newBloomFilter(2*last.capacity, sbf.fpRate)
+		sbf.filters = append(sbf.filters, last)
+	}
+	last.add(h1, h2)
+}
+
+func (sbf *scalableBloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHashes(key)
+
+	sbf.mu.RLock()
+	defer sbf.mu.RUnlock()
+
+	for _, f := range sbf.filters {
+		if f.mayContain(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+type bloomFilter struct {
+	bits     []uint64
+	m        uint64 // number of bits
+	k        uint64 // number of hash functions
+	capacity int
+	count    int
+}
+
+func newBloomFilter(capacity int, fpRate float64) *bloomFilter {
+	m := math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(capacity)*math.Ln2))
+
+	return &bloomFilter{
+		bits:     make([]uint64, (uint64(m)+63)/64),
+		m:        uint64(m),
+		k:        uint64(k),
+		capacity: capacity,
+	}
+}
+
+func (f *bloomFilter) add(h1, h2 uint64) {
+	for i := range f.k {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+func (f *bloomFilter) mayContain(h1, h2 uint64) bool {
+	for i := range f.k {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes derives the k hashes as h1 + i*h2 from a single 64-bit hash.
+func bloomHashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+
+	return sum & math.MaxUint32, sum>>32 | 1
+}
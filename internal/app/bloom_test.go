@@ -0,0 +1,59 @@
+package app
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	const keys, probes, fpRate = 10000, 100000, 0.01
+	sbf := newScalableBloomFilter(keys/8, fpRate)
+
+	for i := range keys {
+		sbf.add("key" + strconv.Itoa(i))
+	}
+	assert.Len(t, sbf.filters, 4, "Filters after scaling")
+
+	for i := range keys {
+		require.True(t, sbf.mayContain("key"+strconv.Itoa(i)), "No false negatives")
+	}
+
+	falsePositives := 0
+	for i := range probes {
+		if sbf.mayContain("probe" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, float64(falsePositives)/probes, fpRate, "False positive rate")
+}
+
+func TestBloomStorageSkipsUnknownKeys(t *testing.T) {
+	cfg, err := newConfig(WithLogger(testLogger{t: t}), WithMemoryStorage(), WithBloomFPRate("0.01"))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	lookups := new(int)
+	st := countingStorage{newInMemStorage(), lookups}
+	existing := link{shortKey: shortKey{1, "aaaaab"}, originalURL: "https://pkg.go.dev/cmp"}
+	require.NoError(t, st.Store(ctx, existing))
+
+	bs, err := newBloomStorage(ctx, st, cfg)
+	require.NoError(t, err)
+
+	_, err = bs.Peek(ctx, existing.shortURL)
+	assert.NoError(t, err, "Key loaded at startup")
+
+	stored := link{shortKey: shortKey{2, "aaaaac"}, originalURL: "https://pkg.go.dev/time"}
+	require.NoError(t, bs.Store(ctx, stored))
+	_, err = bs.Peek(ctx, stored.shortURL)
+	assert.NoError(t, err, "Stored key")
+	assert.Equal(t, 2, *lookups, "Storage lookups of existing keys")
+
+	_, err = bs.Peek(ctx, "unknown")
+	assert.ErrorIs(t, err, errNotFound)
+	assert.Equal(t, 2, *lookups, "Storage lookups after an unknown key")
+}
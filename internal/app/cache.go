@@ -0,0 +1,224 @@
+package app
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// cachedStorage is a read-through cache of the looked up links and, if enabled, of the unknown keys.
+// Click-limited links are never cached because their clicks are counted down in the storage.
+// The cache only sees the changes made by this instance, so the TTL bounds
+// how long the changes of other instances may go unnoticed.
+type cachedStorage struct {
+	storage
+	cache  *lruCache
+	misses bool // whether the unknown keys are cached
+}
+
+func newCachedStorage(st storage, cfg config) cachedStorage {
+	cs := cachedStorage{st, newLRUCache(cfg.cacheSize, cfg.cacheTTL), cfg.cacheMisses}
+	cs.cache.registerMetrics(cfg.metrics)
+
+	return cs
+}
+
+func (cs cachedStorage) Peek(ctx context.Context, shortURL string) (link, error) {
+	if e, ok := cs.get(ctx, shortURL); ok {
+		return e.l, e.err
+	}
+
+	gen := cs.cache.generation()
+	l, err := cs.storage.Peek(ctx, shortURL)
+	cs.remember(shortURL, l, err, gen)
+
+	return l, err
+}
+
+// get marks the storage span of the lookup, so that the hits can be told from the queries.
+func (cs cachedStorage) get(ctx context.Context, shortURL string) (cacheEntry, bool) {
+	e, ok := cs.cache.get(shortURL, time.Now())
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.hit", ok))
+
+	return e, ok
+}
+
+func (cs cachedStorage) remember(shortURL string, l link, err error, gen uint64) {
+	if (err == nil && !l.clickLimited()) || (cs.misses && errors.Is(err, errNotFound)) {
+		cs.cache.fill(shortURL, l, err, time.Now(), gen)
+	}
+}
+
+// Store forgets the key in case it was looked up before it existed.
+func (cs cachedStorage) Store(ctx context.Context, l link) error {
+	defer cs.cache.remove(l.shortURL)
+
+	return cs.storage.Store(ctx, l)
+}
+
+func (cs cachedStorage) StoreBatch(ctx context.Context, batch urlBatch) error {
+	defer func() {
+		for _, l := range batch {
+			cs.cache.remove(l.shortURL)
+		}
+	}()
+
+	return cs.storage.StoreBatch(ctx, batch)
+}
+
+func (cs cachedStorage) ConsumeClick(ctx context.Context, l link) (link, error) {
+	defer cs.cache.remove(l.shortURL)
+
+	return cs.storage.ConsumeClick(ctx, l)
+}
+
+func (cs cachedStorage) Delete(ctx context.Context, shortURL string) error {
+	defer cs.cache.remove(shortURL)
+
+	return cs.storage.Delete(ctx, shortURL)
+}
+
+func (cs cachedStorage) PurgeExpired(ctx context.Context, now time.Time) ([]string, error) {
+	purged, err := cs.storage.PurgeExpired(ctx, now)
+	for _, shortURL := range purged {
+		cs.cache.remove(shortURL)
+	}
+
+	return purged, err
+}
+
+type cacheEntry struct {
+	shortURL  string
+	l         link
+	err       error
+	expiresAt time.Time
+}
+
+// lruCache evicts the least recently used entry when it is full.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List // the most recently used entry is at the front
+	// gen changes with every removal, so that a lookup racing with a change
+	// doesn't put back the link it read before the change
+	gen uint64
+
+	hits, misses atomic.Int64
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+func (c *lruCache) registerMetrics(reg prometheus.Registerer) {
+	const name, help = "cache_lookups_total", "Number of link cache lookups per result: hit or miss."
+	for result, n := range map[string]*atomic.Int64{"hit": &c.hits, "miss": &c.misses} {
+		reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        name,
+			Help:        help,
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 { return float64(n.Load()) }))
+	}
+	registerGauge(reg, "cache_hit_ratio", "Share of the link cache lookups that were hits.", nil, c.hitRatio)
+	registerGauge(reg, "cache_entries", "Number of entries in the link cache.", nil, func() float64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return float64(c.order.Len())
+	})
+}
+
+func (c *lruCache) hitRatio() float64 {
+	hits := c.hits.Load()
+	total := hits + c.misses.Load()
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+func (c *lruCache) get(shortURL string, now time.Time) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[shortURL]
+	if ok && now.After(el.Value.(cacheEntry).expiresAt) {
+		c.order.Remove(el)
+		delete(c.entries, shortURL)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		return cacheEntry{}, false
+	}
+
+	c.hits.Add(1)
+	c.order.MoveToFront(el)
+	return el.Value.(cacheEntry), true
+}
+
+func (c *lruCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// fill puts the entry read from the storage unless anything was removed since the generation.
+func (c *lruCache) fill(shortURL string, l link, err error, now time.Time, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen == c.gen {
+		c.insert(shortURL, l, err, now)
+	}
+}
+
+func (c *lruCache) put(shortURL string, l link, err error, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.insert(shortURL, l, err, now)
+}
+
+func (c *lruCache) insert(shortURL string, l link, err error, now time.Time) {
+	e := cacheEntry{shortURL, l, err, now.Add(c.ttl)}
+	if el, ok := c.entries[shortURL]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(cacheEntry).shortURL)
+	}
+	c.entries[shortURL] = c.order.PushFront(e)
+}
+
+func (c *lruCache) remove(shortURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if el, ok := c.entries[shortURL]; ok {
+		c.order.Remove(el)
+		delete(c.entries, shortURL)
+	}
+}
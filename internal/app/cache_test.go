@@ -0,0 +1,191 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type countingStorage struct {
+	inMemStorage
+	lookups *int
+}
+
+func (cs countingStorage) Peek(ctx context.Context, shortURL string) (link, error) {
+	*cs.lookups++
+	return cs.inMemStorage.Peek(ctx, shortURL)
+}
+
+func newTestCache(t *testing.T, size int, ttl time.Duration) (cachedStorage, *int) {
+	cfg, err := newConfig(WithLogger(testLogger{t: t}), WithMemoryStorage())
+	require.NoError(t, err)
+	cfg.cacheSize, cfg.cacheTTL = size, ttl
+
+	lookups := new(int)
+	return newCachedStorage(countingStorage{newInMemStorage(), lookups}, cfg), lookups
+}
+
+func TestCacheHitsAndMisses(t *testing.T) {
+	cs, lookups := newTestCache(t, 10, time.Minute)
+	cs.misses = true
+	ctx := context.Background()
+	l := link{shortKey: shortKey{1, "aaaaab"}, originalURL: "https://pkg.go.dev/cmp"}
+
+	_, err := cs.Peek(ctx, l.shortURL)
+	assert.ErrorIs(t, err, errNotFound)
+	_, err = cs.Peek(ctx, l.shortURL)
+	assert.ErrorIs(t, err, errNotFound, "Cached negative result")
+	assert.Equal(t, 1, *lookups, "Storage lookups")
+
+	require.NoError(t, cs.Store(ctx, l))
+	for range 3 {
+		found, err := cs.Peek(ctx, l.shortURL)
+		require.NoError(t, err)
+		assert.Equal(t, l, found)
+	}
+	assert.Equal(t, 2, *lookups, "Storage lookups after the key was stored")
+	assert.InDelta(t, 3.0/5, cs.cache.hitRatio(), 1e-9, "Hit ratio")
+}
+
+func TestCacheSkipsMissesByDefault(t *testing.T) {
+	cs, lookups := newTestCache(t, 10, time.Minute)
+	ctx := context.Background()
+	l := link{shortKey: shortKey{1, "aaaaab"}, originalURL: "https://pkg.go.dev/cmp"}
+
+	_, err := cs.Peek(ctx, l.shortURL)
+	assert.ErrorIs(t, err, errNotFound)
+	// stored by another instance sharing the database
+	require.NoError(t, cs.storage.Store(ctx, l))
+
+	found, err := cs.Peek(ctx, l.shortURL)
+	require.NoError(t, err, "Key stored behind the cache")
+	assert.Equal(t, l, found)
+	assert.Equal(t, 2, *lookups, "Storage lookups")
+}
+
+func TestCacheSkipsClickLimitedLinks(t *testing.T) {
+	cs, lookups := newTestCache(t, 10, time.Minute)
+	ctx := context.Background()
+	l := link{shortKey: shortKey{1, "aaaaab"}, originalURL: "https://pkg.go.dev/cmp", maxClicks: 2, clicksLeft: 2}
+	require.NoError(t, cs.Store(ctx, l))
+
+	for range 2 {
+		found, err := cs.Peek(ctx, l.shortURL)
+		require.NoError(t, err)
+		_, err = cs.ConsumeClick(ctx, found)
+		require.NoError(t, err)
+	}
+	found, err := cs.Peek(ctx, l.shortURL)
+	require.NoError(t, err)
+	assert.True(t, found.exhausted(), "Exhausted link")
+	assert.Equal(t, 3, *lookups, "Storage lookups")
+}
+
+// pausedStorage holds the first lookup back after it has read the link.
+type pausedStorage struct {
+	inMemStorage
+	read, resume chan struct{}
+}
+
+func (ps pausedStorage) Peek(ctx context.Context, shortURL string) (link, error) {
+	l, err := ps.inMemStorage.Peek(ctx, shortURL)
+	ps.read <- struct{}{}
+	<-ps.resume
+	return l, err
+}
+
+func TestCacheSkipsLinksChangedDuringLookUp(t *testing.T) {
+	cfg, err := newConfig(WithLogger(testLogger{t: t}), WithMemoryStorage())
+	require.NoError(t, err)
+	ps := pausedStorage{newInMemStorage(), make(chan struct{}, 1), make(chan struct{})}
+	cs := newCachedStorage(ps, cfg)
+	ctx := context.Background()
+	l := link{shortKey: shortKey{1, "aaaaab"}, originalURL: "https://pkg.go.dev/cmp"}
+	require.NoError(t, ps.Store(ctx, l))
+
+	looked := make(chan error)
+	go func() {
+		_, err := cs.Peek(ctx, l.shortURL)
+		looked <- err
+	}()
+	<-ps.read
+	require.NoError(t, cs.Delete(ctx, l.shortURL))
+	close(ps.resume)
+	require.NoError(t, <-looked, "Link read before the deletion")
+
+	_, err = cs.Peek(ctx, l.shortURL)
+	assert.ErrorIs(t, err, errNotFound, "Deleted link not cached")
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache(2, time.Minute)
+	now := time.Now()
+
+	c.put("a", link{}, nil, now)
+	c.put("b", link{}, nil, now)
+	_, ok := c.get("a", now)
+	require.True(t, ok)
+	c.put("c", link{}, nil, now)
+
+	_, ok = c.get("b", now)
+	assert.False(t, ok, "Least recently used entry evicted")
+	_, ok = c.get("a", now)
+	assert.True(t, ok, "Recently used entry kept")
+	_, ok = c.get("c", now.Add(2*time.Minute))
+	assert.False(t, ok, "Expired entry")
+}
+
+func TestCacheMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := newLRUCache(2, time.Minute)
+	c.registerMetrics(reg)
+
+	c.put("a", link{}, nil, time.Now())
+	c.get("a", time.Now())
+	c.get("b", time.Now())
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			name := f.GetName()
+			for _, l := range m.GetLabel() {
+				name += "_" + l.GetValue()
+			}
+			values[name] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"shorturl_cache_lookups_total_hit":  1,
+		"shorturl_cache_lookups_total_miss": 1,
+		"shorturl_cache_hit_ratio":          0.5,
+		"shorturl_cache_entries":            1,
+	}, values)
+}
+
+func TestCacheHitsAreTraced(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	cs, _ := newTestCache(t, 10, time.Minute)
+	st := tracedStorage{cs, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer(tracerName)}
+	ctx := context.Background()
+	l := link{shortKey: shortKey{1, "aaaaab"}, originalURL: "https://pkg.go.dev/cmp"}
+	require.NoError(t, cs.Store(ctx, l))
+
+	for range 2 {
+		_, err := st.Peek(ctx, l.shortURL)
+		require.NoError(t, err)
+	}
+
+	spans := sr.Ended()
+	require.Len(t, spans, 2)
+	assert.Contains(t, spans[0].Attributes(), attribute.Bool("cache.hit", false), "Miss")
+	assert.Contains(t, spans[1].Attributes(), attribute.Bool("cache.hit", true), "Hit")
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type click struct {
+	shortURL  string
+	at        time.Time
+	referrer  string
+	userAgent string
+	ip        string // hashed into ipHash before the click is recorded
+	ipHash    string
+}
+
+// Visitors are the estimated numbers of unique client IP and user agent combinations.
+type ClickStats struct {
+	Key      string        `json:"key"`
+	Total    int64         `json:"total"`
+	Visitors uint64        `json:"visitors"`
+	Daily    []DailyClicks `json:"daily"`
+}
+
+type DailyClicks struct {
+	Date     string `json:"date"` // UTC date in the YYYY-MM-DD format
+	Clicks   int64  `json:"clicks"`
+	Visitors uint64 `json:"visitors"`
+}
+
+const dateLayout = time.DateOnly
+
+const (
+	clickBufferSize = 10000
+	clickBatchSize  = 500
+)
+
+// clickRecorder stores the clicks in batches in the background
+// so that redirects don't wait for the storage.
+type clickRecorder struct {
+	ch       chan click
+	st       storage
+	visitors *visitorCounter
+	log      logger
+	dropped  *atomic.Int64
+	flushes  chan chan struct{}
+}
+
+func newClickRecorder(st storage, visitors *visitorCounter, log logger) clickRecorder {
+	cr := clickRecorder{
+		ch:       make(chan click, clickBufferSize),
+		st:       st,
+		visitors: visitors,
+		log:      log,
+		dropped:  &atomic.Int64{},
+		flushes:  make(chan chan struct{}),
+	}
+	go cr.run()
+
+	return cr
+}
+
+// record drops the click rather than blocking when the buffer is full.
+func (cr clickRecorder) record(c click) {
+	select {
+	case cr.ch <- c:
+	default:
+		cr.dropped.Add(1)
+	}
+}
+
+// run stores whatever is buffered as soon as the storage is done with the previous batch.
+func (cr clickRecorder) run() {
+	writeQueued(cr.ch, cr.flushes, cr.store)
+}
+
+func (cr clickRecorder) store(c click) {
+	batch := []click{c}
+	for len(batch) < clickBatchSize && len(cr.ch) > 0 {
+		batch = append(batch, <-cr.ch)
+	}
+
+	if err := cr.st.StoreClicks(context.Background(), batch); err != nil {
+		cr.log.Error(err, "storing %d clicks", len(batch))
+	}
+	cr.visitors.add(batch)
+	if dropped := cr.dropped.Swap(0); dropped > 0 {
+		cr.log.Warn("dropped %d clicks due to full buffer", dropped)
+	}
+}
+
+// flush waits for the clicks recorded so far to be stored.
+func (cr clickRecorder) flush(ctx context.Context) error {
+	return flushQueued(ctx, cr.flushes)
+}
+
+func newClick(r *http.Request, shortURL string) click {
+	return click{
+		shortURL:  shortURL,
+		at:        time.Now().UTC(),
+		referrer:  r.Referer(),
+		userAgent: r.UserAgent(),
+		ip:        clientIP(r),
+	}
+}
+
+// The salt makes it impractical to recover the address by hashing all possible ones.
+func hashIP(ip, salt string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,426 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axiomhq/hyperloglog"
+)
+
+// clickCounts keeps the number of clicks per short URL and day.
+type clickCounts struct {
+	mu    sync.Mutex
+	daily map[string]map[string]int64
+}
+
+func newClickCounts() *clickCounts {
+	return &clickCounts{daily: make(map[string]map[string]int64)}
+}
+
+func (cc *clickCounts) add(clicks []click) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for _, c := range clicks {
+		days, ok := cc.daily[c.shortURL]
+		if !ok {
+			days = make(map[string]int64)
+			cc.daily[c.shortURL] = days
+		}
+		days[c.at.UTC().Format(dateLayout)]++
+	}
+}
+
+func (cc *clickCounts) stats(shortURL string) []DailyClicks {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	daily := make([]DailyClicks, 0, len(cc.daily[shortURL]))
+	for date, n := range cc.daily[shortURL] {
+		daily = append(daily, DailyClicks{Date: date, Clicks: n})
+	}
+	slices.SortFunc(daily, func(a, b DailyClicks) int {
+		return strings.Compare(a.Date, b.Date)
+	})
+
+	return daily
+}
+
+func (s inMemStorage) StoreClicks(ctx context.Context, clicks []click) error {
+	s.clicks.add(clicks)
+
+	return nil
+}
+
+func (s inMemStorage) ClickStats(ctx context.Context, shortURL string) ([]DailyClicks, error) {
+	return s.clicks.stats(shortURL), nil
+}
+
+// clicksPath is the path of the file with click events next to the file storage.
+func clicksPath(storagePath string) string {
+	return storagePath + ".clicks"
+}
+
+type clickRec struct {
+	ShortURL  string    `json:"short_url"`
+	At        time.Time `json:"at"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IPHash    string    `json:"ip_hash,omitempty"`
+}
+
+func (fs fileStorage) StoreClicks(ctx context.Context, clicks []click) error {
+	if err := fs.storage.StoreClicks(ctx, clicks); err != nil {
+		return err
+	}
+
+	fs.clicks <- clicks
+
+	return nil
+}
+
+func (fs fileStorage) storeClickRecs(file *os.File, flushes chan chan struct{}) {
+	encoder := json.NewEncoder(file)
+
+	writeQueued(fs.clicks, flushes, func(clicks []click) {
+		for _, c := range clicks {
+			rec := clickRec{c.shortURL, c.at, c.referrer, c.userAgent, c.ipHash}
+			if err := encoder.Encode(&rec); err != nil {
+				fs.log.Error(err, "writing click %v to file %s", rec, file.Name())
+			}
+		}
+		if err := file.Sync(); err != nil {
+			fs.log.Error(err, "syncing file %s to disc", file.Name())
+		}
+	})
+}
+
+func readClicksFile(st inMemStorage, path string) error {
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		rec := clickRec{}
+		err = decoder.Decode(&rec)
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to decode click at offset %d: %w", decoder.InputOffset(), err)
+		}
+
+		st.clicks.add([]click{{shortURL: rec.ShortURL, at: rec.At, referrer: rec.Referrer,
+			userAgent: rec.UserAgent, ipHash: rec.IPHash}})
+	}
+}
+
+const createClicksTable = `
+CREATE TABLE IF NOT EXISTS clicks (
+	short_url TEXT NOT NULL,
+	clicked_at TIMESTAMPTZ NOT NULL,
+	referrer TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip_hash TEXT NOT NULL DEFAULT ''
+);`
+
+func (pst pgsqlStorage) StoreClicks(ctx context.Context, clicks []click) error {
+	const query = `
+		INSERT INTO clicks (short_url, clicked_at, referrer, user_agent, ip_hash)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+
+	tx, err := pst.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, c := range clicks {
+		_, err = stmt.ExecContext(ctx, c.shortURL, c.at, c.referrer, c.userAgent, c.ipHash)
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		stmt.Close()
+		err = tx.Commit()
+	}
+
+	return err
+}
+
+func (pst pgsqlStorage) ClickStats(ctx context.Context, shortURL string) ([]DailyClicks, error) {
+	const query = `
+		SELECT to_char(clicked_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*)
+		FROM clicks WHERE short_url = $1
+		GROUP BY day ORDER BY day
+	`
+	rows, err := pst.db.QueryContext(ctx, query, shortURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query clicks of %s: %w", shortURL, err)
+	}
+	defer rows.Close()
+
+	daily := []DailyClicks{}
+	for rows.Next() {
+		var d DailyClicks
+		if err = rows.Scan(&d.Date, &d.Clicks); err != nil {
+			return nil, err
+		}
+		daily = append(daily, d)
+	}
+
+	return daily, rows.Err()
+}
+
+type visitorSketches struct {
+	mu       sync.Mutex
+	sketches sketches
+}
+
+func (s inMemStorage) StoreSketches(ctx context.Context, sketches []dailySketch) error {
+	s.visitors.mu.Lock()
+	defer s.visitors.mu.Unlock()
+
+	for _, ds := range sketches {
+		if err := s.visitors.sketches.merge(ds); err != nil {
+			return fmt.Errorf("failed to merge visitors of %s on %s: %w", ds.shortURL, ds.date, err)
+		}
+	}
+	return nil
+}
+
+func (s inMemStorage) LoadSketches(ctx context.Context, shortURL string) ([]dailySketch, error) {
+	s.visitors.mu.Lock()
+	defer s.visitors.mu.Unlock()
+
+	return s.visitors.sketches.daily(shortURL), nil
+}
+
+// visitorsPath is the path of the file with visitor sketches next to the file storage.
+// Every record is merged with the previous ones of the same short URL and day.
+func visitorsPath(storagePath string) string {
+	return storagePath + ".visitors"
+}
+
+type sketchRec struct {
+	ShortURL string `json:"short_url"`
+	Date     string `json:"date"`
+	Sketch   []byte `json:"sketch"`
+}
+
+func (fs fileStorage) StoreSketches(ctx context.Context, sketches []dailySketch) error {
+	if err := fs.storage.StoreSketches(ctx, sketches); err != nil {
+		return err
+	}
+
+	fs.visitors <- sketches
+
+	return nil
+}
+
+func (fs fileStorage) storeSketchRecs(file *os.File, flushes chan chan struct{}) {
+	encoder := json.NewEncoder(file)
+
+	writeQueued(fs.visitors, flushes, func(sketches []dailySketch) {
+		for _, ds := range sketches {
+			b, err := ds.sketch.MarshalBinary()
+			if err == nil {
+				err = encoder.Encode(&sketchRec{ds.shortURL, ds.date, b})
+			}
+			if err != nil {
+				fs.log.Error(err, "writing visitors of %s on %s to file %s", ds.shortURL, ds.date, file.Name())
+			}
+		}
+		if err := file.Sync(); err != nil {
+			fs.log.Error(err, "syncing file %s to disc", file.Name())
+		}
+	})
+}
+
+func readVisitorsFile(st inMemStorage, path string) error {
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		rec := sketchRec{}
+		err = decoder.Decode(&rec)
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to decode visitors at offset %d: %w", decoder.InputOffset(), err)
+		}
+
+		sk := hyperloglog.New()
+		if err = sk.UnmarshalBinary(rec.Sketch); err != nil {
+			return fmt.Errorf("failed to decode visitors of %s on %s: %w", rec.ShortURL, rec.Date, err)
+		}
+		err = st.StoreSketches(context.TODO(), []dailySketch{{rec.ShortURL, rec.Date, sk}})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+const createSketchesTable = `
+CREATE TABLE IF NOT EXISTS visitor_sketches (
+	short_url TEXT NOT NULL,
+	day DATE NOT NULL,
+	sketch BYTEA NOT NULL,
+	PRIMARY KEY (short_url, day)
+);`
+
+// StoreSketches locks the rows of the merged sketches
+// so that concurrent instances don't overwrite each other's visitors.
+func (pst pgsqlStorage) StoreSketches(ctx context.Context, sketches []dailySketch) error {
+	const (
+		ensureRow = `
+			INSERT INTO visitor_sketches (short_url, day, sketch) VALUES ($1, $2, '')
+			ON CONFLICT (short_url, day) DO NOTHING
+		`
+		lockRow = "SELECT sketch FROM visitor_sketches WHERE short_url = $1 AND day = $2 FOR UPDATE"
+		update  = "UPDATE visitor_sketches SET sketch = $3 WHERE short_url = $1 AND day = $2"
+	)
+
+	tx, err := pst.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, ds := range sketches {
+		if _, err = tx.ExecContext(ctx, ensureRow, ds.shortURL, ds.date); err != nil {
+			return err
+		}
+
+		var stored []byte
+		if err = tx.QueryRowContext(ctx, lockRow, ds.shortURL, ds.date).Scan(&stored); err != nil {
+			return err
+		}
+
+		merged, err := mergeStored(stored, ds.sketch)
+		if err != nil {
+			return fmt.Errorf("failed to merge visitors of %s on %s: %w", ds.shortURL, ds.date, err)
+		}
+
+		if _, err = tx.ExecContext(ctx, update, ds.shortURL, ds.date, merged); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func mergeStored(stored []byte, sk *hyperloglog.Sketch) ([]byte, error) {
+	if len(stored) == 0 {
+		return sk.MarshalBinary()
+	}
+
+	merged := hyperloglog.New()
+	if err := merged.UnmarshalBinary(stored); err != nil {
+		return nil, err
+	}
+	if err := merged.Merge(sk); err != nil {
+		return nil, err
+	}
+	return merged.MarshalBinary()
+}
+
+func (pst pgsqlStorage) LoadSketches(ctx context.Context, shortURL string) ([]dailySketch, error) {
+	const query = `
+		SELECT to_char(day, 'YYYY-MM-DD'), sketch
+		FROM visitor_sketches WHERE short_url = $1 AND sketch <> ''
+	`
+	rows, err := pst.db.QueryContext(ctx, query, shortURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query visitors of %s: %w", shortURL, err)
+	}
+	defer rows.Close()
+
+	var daily []dailySketch
+	for rows.Next() {
+		ds := dailySketch{shortURL: shortURL, sketch: hyperloglog.New()}
+		var b []byte
+		if err = rows.Scan(&ds.date, &b); err != nil {
+			return nil, err
+		}
+		if err = ds.sketch.UnmarshalBinary(b); err != nil {
+			return nil, fmt.Errorf("failed to decode visitors of %s on %s: %w", shortURL, ds.date, err)
+		}
+		daily = append(daily, ds)
+	}
+
+	return daily, rows.Err()
+}
+
+// The IP hash salt is kept with the clicks, so that the hashes of a client
+// match across restarts and instances. The in-memory clicks don't outlive the salt.
+func (s inMemStorage) IPHashSalt(ctx context.Context, generated string) (string, error) {
+	return generated, nil
+}
+
+// saltPath is the path of the file with the IP hash salt next to the file storage.
+func saltPath(storagePath string) string {
+	return storagePath + ".salt"
+}
+
+func (fs fileStorage) IPHashSalt(ctx context.Context, generated string) (string, error) {
+	b, err := os.ReadFile(fs.saltPath)
+	if err == nil {
+		return string(b), nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read file %s: %w", fs.saltPath, err)
+	}
+
+	if err = os.WriteFile(fs.saltPath, []byte(generated), 0600); err != nil {
+		return "", fmt.Errorf("failed to write file %s: %w", fs.saltPath, err)
+	}
+	return generated, nil
+}
+
+const createSecretsTable = `
+CREATE TABLE IF NOT EXISTS secrets (
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);`
+
+// IPHashSalt keeps the salt of the first instance, the others read it back.
+func (pst pgsqlStorage) IPHashSalt(ctx context.Context, generated string) (string, error) {
+	const (
+		insert = `
+			INSERT INTO secrets (name, value) VALUES ('ip_hash_salt', $1)
+			ON CONFLICT (name) DO NOTHING`
+		query = "SELECT value FROM secrets WHERE name = 'ip_hash_salt'"
+	)
+
+	if _, err := pst.db.ExecContext(ctx, insert, generated); err != nil {
+		return "", err
+	}
+	var salt string
+	err := pst.db.QueryRowContext(ctx, query).Scan(&salt)
+	return salt, err
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"testing"
 
@@ -45,6 +46,16 @@ func (c Client) ShortenAPI(url, baseURL string) string {
 	return c.extractKeyAPI(baseURL, body)
 }
 
+func (c Client) ShortenWithOptions(req ShortURLRequest, baseURL string) string {
+	body := c.callShortenerWithOptions(req, http.StatusCreated)
+
+	return c.extractKeyAPI(baseURL, body)
+}
+
+func (c Client) ShortenInvalidOptions(req ShortURLRequest) {
+	c.callShortenerWithOptions(req, http.StatusBadRequest)
+}
+
 func (c Client) ShortenConflict(url, baseURL string) string {
 	body := c.callShortener(url, http.StatusConflict)
 
@@ -57,6 +68,16 @@ func (c Client) ShortenAPIConflict(url, baseURL string) string {
 	return c.extractKeyAPI(baseURL, body)
 }
 
+func (c Client) ShortenRejected(url string) ErrorResponse {
+	body := c.callShortenerAPI(url, http.StatusBadRequest)
+
+	var resp ErrorResponse
+	err := json.Unmarshal([]byte(body), &resp)
+	require.NoError(c.t, err, "failed to unmarshal the error response")
+
+	return resp
+}
+
 func (c Client) extractKey(baseURL string, body string) string {
 	assert.Regexp(c.t, "^"+baseURL, body, "Redirect URL")
 
@@ -91,7 +112,10 @@ func (c Client) callShortener(url string, expectedStatus int) string {
 }
 
 func (c Client) callShortenerAPI(url string, expectedStatus int) string {
-	req := ShortURLRequest{url}
+	return c.callShortenerWithOptions(ShortURLRequest{URL: url}, expectedStatus)
+}
+
+func (c Client) callShortenerWithOptions(req ShortURLRequest, expectedStatus int) string {
 	resp := c.PostJSON("/api/shorten", req)
 	defer resp.Body.Close()
 
@@ -114,6 +138,22 @@ func (c Client) POST(query string, contentType string, body string) *http.Respon
 	return resp
 }
 
+func (c Client) PostForm(query string, form url.Values) *http.Response {
+	resp, err := c.hcl.PostForm(c.BaseURL+query, form)
+	require.NoError(c.t, err, "Failed to POST form")
+
+	return resp
+}
+
+func (c Client) Unlock(key, password string, expectedStatus int) string {
+	resp := c.PostForm("/"+key, url.Values{"password": {password}})
+	defer resp.Body.Close()
+
+	assert.Equal(c.t, expectedStatus, resp.StatusCode, "Response status code for key "+key)
+
+	return resp.Header.Get("Location")
+}
+
 func (c Client) PostJSON(query string, body any) *http.Response {
 	b, err := json.Marshal(body)
 	require.NoError(c.t, err, "request to json")
@@ -137,10 +177,14 @@ func (c Client) PutJSON(query string, body string) *http.Response {
 }
 
 func (c Client) PostAcceptingGzip(query string, body string) *http.Response {
+	return c.PostAccepting(query, "gzip", body)
+}
+
+func (c Client) PostAccepting(query string, acceptEncoding string, body string) *http.Response {
 	req, err := http.NewRequest(http.MethodPost, c.BaseURL+query, strings.NewReader(body))
 	require.NoError(c.t, err, "Failed to creae a POST request")
 	req.Header.Set("Content-Type", ContentTypeJSON)
-	req.Header.Add("Accept-Encoding", "gzip")
+	req.Header.Add("Accept-Encoding", acceptEncoding)
 
 	resp, err := c.hcl.Do(req)
 	require.NoError(c.t, err, "Failed to POST")
@@ -163,6 +207,18 @@ func (c Client) PostGzippedJSON(query string, body string) *http.Response {
 	return resp
 }
 
+func (c Client) PostEncoded(query string, contentEncoding string, body []byte) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, c.BaseURL+query, bytes.NewReader(body))
+	require.NoError(c.t, err, "Failed to creae a POST request")
+	req.Header.Set("Content-Type", ContentTypeJSON)
+	req.Header.Set("Content-Encoding", contentEncoding)
+
+	resp, err := c.hcl.Do(req)
+	require.NoError(c.t, err, "Failed to POST")
+
+	return resp
+}
+
 func (c Client) LookUp(key string) string {
 	resp := c.GET("/" + key)
 	defer resp.Body.Close()
@@ -175,6 +231,15 @@ func (c Client) LookUp(key string) string {
 	return loc
 }
 
+func (c Client) Redirect(key string, expectedStatus int) http.Header {
+	resp := c.GET("/" + key)
+	defer resp.Body.Close()
+
+	assert.Equal(c.t, expectedStatus, resp.StatusCode, "Response status code for key "+key)
+
+	return resp.Header
+}
+
 func (c Client) LookUpByURL(url string) string {
 	resp, err := c.hcl.Get(url)
 	require.NoError(c.t, err, "Failed to make request")
@@ -195,6 +260,13 @@ func (c Client) LookUpNotFound(shortURL string) {
 	assert.Equal(c.t, http.StatusNotFound, resp.StatusCode, "response status code")
 }
 
+func (c Client) LookUpGone(shortURL string) {
+	resp := c.GET("/" + shortURL)
+	defer resp.Body.Close()
+
+	assert.Equal(c.t, http.StatusGone, resp.StatusCode, "response status code")
+}
+
 func (c Client) GET(query string) *http.Response {
 	resp, err := c.hcl.Get(c.BaseURL + query)
 	require.NoError(c.t, err, "Failed to make request")
@@ -202,6 +274,29 @@ func (c Client) GET(query string) *http.Response {
 	return resp
 }
 
+func (c Client) GetWithHeader(query string, header http.Header) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, c.BaseURL+query, nil)
+	require.NoError(c.t, err, "Failed to create a GET request")
+	req.Header = header
+
+	resp, err := c.hcl.Do(req)
+	require.NoError(c.t, err, "Failed to GET")
+
+	return resp
+}
+
+func (c Client) Health(query string, expectedStatus int) Health {
+	resp := c.GET(query)
+	defer resp.Body.Close()
+
+	assert.Equal(c.t, expectedStatus, resp.StatusCode, "Response status code")
+
+	var h Health
+	require.NoError(c.t, json.NewDecoder(resp.Body).Decode(&h), "Failed to decode health")
+
+	return h
+}
+
 func (c Client) Ping() {
 	resp := c.GET("/ping")
 	defer resp.Body.Close()
@@ -246,3 +341,15 @@ func (c Client) Batch(payload BatchRequest) BatchResponse {
 
 	return br
 }
+
+func (c Client) Stats(key string) ClickStats {
+	resp := c.GET("/api/urls/" + key + "/stats")
+	defer resp.Body.Close()
+	require.Equal(c.t, http.StatusOK, resp.StatusCode, "response status code")
+
+	var stats ClickStats
+	err := json.NewDecoder(resp.Body).Decode(&stats)
+	require.NoError(c.t, err, "json to stats")
+
+	return stats
+}
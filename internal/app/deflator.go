@@ -3,70 +3,276 @@ package app
 import (
 	"compress/gzip"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 // New compression algorithms have to implement this interface
-// and provide a middleware constructor. Follow the example for gzip below.
+// and be registered in newDeflator. Follow the example for gzip below.
 type deflator interface {
-	accepts(r *http.Request) bool
-	wrap(rw http.ResponseWriter) *wrappedResponse
+	encoding() string
+	// writer takes a compressor writing to w from the pool.
+	writer(w io.Writer) io.WriteCloser
+	// release puts a closed compressor back to the pool.
+	release(wc io.WriteCloser)
 }
 
-type wrappedResponse struct {
+// compressingWriter holds the response back until it grows to the min size
+// so that the tiny responses like redirects are sent as they are.
+type compressingWriter struct {
 	http.ResponseWriter
-	wc io.WriteCloser
+	d       deflator
+	minSize int
+	status  int
+	buf     []byte
+	decided bool
+	wc      io.WriteCloser // nil unless the response is compressed
+}
+
+func (cw *compressingWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	if !bodyAllowed(status) {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressingWriter) Write(b []byte) (int, error) {
+	if cw.decided {
+		if cw.wc != nil {
+			return cw.wc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the header and the buffered body, compressed if the response is big enough
+// and of a compressible content type.
+func (cw *compressingWriter) decide(bigEnough bool) error {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if bigEnough && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.d.encoding())
+		cw.wc = cw.d.writer(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.Write(buf)
+	return err
 }
 
-func (wr *wrappedResponse) Write(b []byte) (int, error) {
-	return wr.wc.Write(b)
+func (cw *compressingWriter) Close() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return // nothing was written
+		}
+		cw.decide(false)
+	}
+	if cw.wc != nil {
+		cw.wc.Close()
+		cw.d.release(cw.wc)
+	}
 }
 
-func (wr *wrappedResponse) Close() {
-	wr.wc.Close()
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml",
+		"application/x-ndjson", "application/openmetrics-text":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
 }
 
-func compressingMiddleware(d deflator) func(next http.Handler) http.Handler {
+// compressingMiddleware compresses the response with the encoding the client prefers.
+// The deflators are listed in the order of the server preference, which breaks the ties.
+func compressingMiddleware(minSize int, deflators ...deflator) func(next http.Handler) http.Handler {
+	encodings := make([]string, len(deflators))
+	for i, d := range deflators {
+		encodings[i] = d.encoding()
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			effectiveWriter := w
+			w.Header().Add("Vary", "Accept-Encoding")
 
-			if d.accepts(r) {
-				wrapped := d.wrap(w)
-				defer wrapped.Close()
-
-				effectiveWriter = wrapped
+			i := negotiateEncoding(r.Header.Values("Accept-Encoding"), encodings)
+			if i < 0 || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
 			}
 
-			next.ServeHTTP(effectiveWriter, r)
+			cw := &compressingWriter{ResponseWriter: w, d: deflators[i], minSize: minSize}
+			defer cw.Close()
+
+			next.ServeHTTP(cw, r)
 		})
 	}
 }
 
-func newGzipDeflator() func(next http.Handler) http.Handler {
-	return compressingMiddleware(&gzipDeflator{})
+func newDeflator(minSize int) func(next http.Handler) http.Handler {
+	return compressingMiddleware(minSize, &zstdDeflator{}, &brotliDeflator{}, &gzipDeflator{})
+}
+
+// negotiateEncoding returns the index of the supported encoding with the highest q-value
+// in the Accept-Encoding header values or -1 if none of them is acceptable.
+func negotiateEncoding(values []string, supported []string) int {
+	qs := acceptedEncodings(values)
+
+	best, bestQ := -1, 0.0
+	for i, enc := range supported {
+		q, ok := qs[enc]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	return best
+}
+
+// acceptedEncodings maps the codings to their q-values, skipping the malformed ones.
+func acceptedEncodings(values []string) map[string]float64 {
+	qs := make(map[string]float64)
+
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(item, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				continue
+			} else if coding == "x-gzip" {
+				coding = "gzip"
+			}
+
+			q, ok := qValue(params)
+			if ok {
+				qs[coding] = q
+			}
+		}
+	}
+
+	return qs
+}
+
+func qValue(params string) (float64, bool) {
+	for _, p := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(p, "=")
+		if strings.ToLower(strings.TrimSpace(name)) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0, false
+		}
+		return q, true
+	}
+	return 1, true
+}
+
+type gzipDeflator struct {
+	pool sync.Pool
 }
 
-type gzipDeflator struct{}
+func (gd *gzipDeflator) encoding() string {
+	return "gzip"
+}
 
-func (gd *gzipDeflator) wrap(w http.ResponseWriter) *wrappedResponse {
+func (gd *gzipDeflator) writer(w io.Writer) io.WriteCloser {
+	if gz, ok := gd.pool.Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return gz
+	}
 	gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	return gz
+}
 
-	wrapped := &wrappedResponse{w, gz}
-	wrapped.Header().Set("Content-Encoding", "gzip")
+func (gd *gzipDeflator) release(wc io.WriteCloser) {
+	gz := wc.(*gzip.Writer)
+	gz.Reset(io.Discard) // drops the reference to the response
+	gd.pool.Put(gz)
+}
 
-	return wrapped
+type brotliDeflator struct {
+	pool sync.Pool
 }
 
-func (gd *gzipDeflator) accepts(r *http.Request) bool {
-	values := r.Header.Values("Accept-Encoding")
+func (bd *brotliDeflator) encoding() string {
+	return "br"
+}
 
-	for _, v := range values {
-		if strings.Contains(v, "gzip") {
-			return true
-		}
+func (bd *brotliDeflator) writer(w io.Writer) io.WriteCloser {
+	if br, ok := bd.pool.Get().(*brotli.Writer); ok {
+		br.Reset(w)
+		return br
+	}
+	return brotli.NewWriterLevel(w, brotli.BestSpeed)
+}
+
+func (bd *brotliDeflator) release(wc io.WriteCloser) {
+	br := wc.(*brotli.Writer)
+	br.Reset(io.Discard)
+	bd.pool.Put(br)
+}
+
+type zstdDeflator struct {
+	pool sync.Pool
+}
+
+func (zd *zstdDeflator) encoding() string {
+	return "zstd"
+}
+
+func (zd *zstdDeflator) writer(w io.Writer) io.WriteCloser {
+	if zw, ok := zd.pool.Get().(*zstd.Encoder); ok {
+		zw.Reset(w)
+		return zw
 	}
+	zw, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	return zw
+}
 
-	return false
+func (zd *zstdDeflator) release(wc io.WriteCloser) {
+	zw := wc.(*zstd.Encoder)
+	zw.Reset(io.Discard)
+	zd.pool.Put(zw)
 }
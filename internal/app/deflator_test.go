@@ -0,0 +1,102 @@
+package app
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveCompressed(h http.HandlerFunc, minSize int) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	newDeflator(minSize)(h).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	body := strings.Repeat("a", 100)
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "100")
+		io.WriteString(w, body[:50])
+		io.WriteString(w, body[50:])
+	}
+
+	rec := serveCompressed(h, 101)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "Content encoding below the threshold")
+	assert.Equal(t, "100", rec.Header().Get("Content-Length"), "Content length below the threshold")
+	assert.Equal(t, body, rec.Body.String())
+
+	rec = serveCompressed(h, 100)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), "Content encoding at the threshold")
+	assert.Empty(t, rec.Header().Get("Content-Length"), "Content length at the threshold")
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(decompressed))
+}
+
+func TestIncompressibleContentTypes(t *testing.T) {
+	tests := []struct {
+		contentType string
+		compressed  bool
+	}{
+		{"image/png", false},
+		{"application/zip", false},
+		{"application/octet-stream", false},
+		{"text/html; charset=utf-8", true},
+		{"application/json", true},
+		{"application/problem+json", true},
+		{"image/svg+xml", true},
+	}
+
+	for _, tt := range tests {
+		rec := serveCompressed(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			io.WriteString(w, strings.Repeat("a", 2048))
+		}, 1024)
+
+		assert.Equal(t, tt.compressed, rec.Header().Get("Content-Encoding") == "gzip", tt.contentType)
+	}
+}
+
+func TestBodilessResponsesAreNotCompressed(t *testing.T) {
+	rec := serveCompressed(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, 0)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Zero(t, rec.Body.Len())
+}
+
+func BenchmarkCompressingMiddleware(b *testing.B) {
+	body := []byte(strings.Repeat(`{"short_url":"http://localhost:8080/aaaaab","original_url":"https://pkg.go.dev/cmp"},`, 64))
+	h := newDeflator(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentTypeJSON)
+		w.Write(body)
+	}))
+
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		b.Run(encoding, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			b.ReportAllocs()
+
+			for b.Loop() {
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+var errDraining = errors.New("server is shutting down")
+
+// newHealth fails if any of the checks fails. Nil errors are passed checks.
+func newHealth(checks map[string]error) Health {
+	h := Health{Status: healthOK, Checks: make(map[string]HealthCheck, len(checks))}
+	for name, err := range checks {
+		if err != nil {
+			h.Status = healthFail
+			h.Checks[name] = HealthCheck{Status: healthFail, Error: err.Error()}
+		} else {
+			h.Checks[name] = HealthCheck{Status: healthOK}
+		}
+	}
+	return h
+}
+
+// Healthz tells that the process is alive and serving requests.
+func (a adapter) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, Health{Status: healthOK})
+}
+
+// Readyz tells whether the instance should receive traffic.
+func (a adapter) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := a.svc.Readiness(r.Context())
+
+	checks["draining"] = nil
+	if a.draining.Load() {
+		checks["draining"] = errDraining
+	}
+
+	writeHealth(w, newHealth(checks))
+}
+
+func writeHealth(w http.ResponseWriter, h Health) {
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	if h.Status == healthOK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(h)
+}
+
+// The file writer is backlogged when any of its queues is almost full
+// so that the requests would soon block on it.
+func backlogged(queue string, length, capacity int) error {
+	if length >= capacity*9/10 {
+		return fmt.Errorf("%s queue has %d of %d records", queue, length, capacity)
+	}
+	return nil
+}
+
+func (s inMemStorage) Readiness(ctx context.Context) map[string]error {
+	return map[string]error{"storage": nil}
+}
+
+func (fs fileStorage) Readiness(ctx context.Context) map[string]error {
+	checks := fs.storage.Readiness(ctx)
+	checks["file_writer"] = errors.Join(
+		backlogged("urls", len(fs.ch), cap(fs.ch)),
+		backlogged("clicks", len(fs.clicks), cap(fs.clicks)),
+		backlogged("visitors", len(fs.visitors), cap(fs.visitors)),
+	)
+	return checks
+}
+
+func (pst pgsqlStorage) Readiness(ctx context.Context) map[string]error {
+	checks := map[string]error{"storage": pst.Ping(ctx)}
+	if checks["storage"] == nil {
+		checks["migrations"] = pst.checkMigrations(ctx)
+	}
+	return checks
+}
+
+// checkMigrations looks for every column of the schema, so that an instance
+// whose migrations didn't complete isn't sent any traffic.
+func (pst pgsqlStorage) checkMigrations(ctx context.Context) error {
+	const query = `
+		SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = current_schema()`
+
+	rows, err := pst.db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to check schema: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[tableColumn]bool)
+	for rows.Next() {
+		var c tableColumn
+		if err = rows.Scan(&c.table, &c.column); err != nil {
+			return fmt.Errorf("failed to check schema: %w", err)
+		}
+		found[c] = true
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to check schema: %w", err)
+	}
+
+	var missing []string
+	for _, c := range schemaColumns(schema) {
+		if !found[c] {
+			missing = append(missing, c.table+"."+c.column)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("schema is missing columns %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+type tableColumn struct {
+	table  string
+	column string
+}
+
+var (
+	createTableDDL = regexp.MustCompile(`(?is)^\s*CREATE TABLE IF NOT EXISTS (\w+) \((.*)\);?\s*$`)
+	addColumnDDL   = regexp.MustCompile(`(?i)^\s*ALTER TABLE (\w+) ADD COLUMN IF NOT EXISTS (\w+)`)
+)
+
+// schemaColumns lists the columns created by the statements of the schema.
+// The lines of CREATE TABLE starting with a constraint rather than a column are skipped.
+func schemaColumns(ddls []string) []tableColumn {
+	var columns []tableColumn
+	for _, ddl := range ddls {
+		if m := addColumnDDL.FindStringSubmatch(ddl); m != nil {
+			columns = append(columns, tableColumn{m[1], m[2]})
+			continue
+		}
+		m := createTableDDL.FindStringSubmatch(ddl)
+		if m == nil {
+			continue
+		}
+		for _, line := range strings.Split(m[2], "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			switch strings.ToUpper(fields[0]) {
+			case "PRIMARY", "UNIQUE", "CONSTRAINT", "FOREIGN", "CHECK":
+				continue
+			}
+			columns = append(columns, tableColumn{m[1], fields[0]})
+		}
+	}
+	return columns
+}
@@ -2,46 +2,169 @@ package app
 
 import (
 	"compress/gzip"
+	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 // New compression algorithms have to implement this interface
-// and provide a middleware constructor. Follow the example for gzip below.
+// and be registered in newInflator. Follow the example for gzip below.
 type inflator interface {
-	isCompressed(r *http.Request) bool
+	encoding() string
 	wrap(rc io.ReadCloser) (io.ReadCloser, error)
 }
 
-func inflatorMiddleware(inflator inflator) func(next http.Handler) http.Handler {
+// Every layer of a stacked encoding takes a decompressor, so there can't be too many of them.
+const maxStackedEncodings = 3
+
+// inflatorMiddleware decompresses the request body, undoing the encodings in the reverse order
+// of the Content-Encoding header. Both the body as received and the decompressed one are limited,
+// so that a small compressed payload can't expand into gigabytes.
+func inflatorMiddleware(maxSize, maxDecompressedSize int64, inflators ...inflator) func(next http.Handler) http.Handler {
+	byEncoding := make(map[string]inflator, len(inflators))
+	for _, inf := range inflators {
+		byEncoding[inf.encoding()] = inf
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if inflator.isCompressed(r) {
-				body, err := inflator.wrap(r.Body)
+			encodings := contentEncodings(r.Header.Values("Content-Encoding"))
+			if len(encodings) > maxStackedEncodings {
+				http.Error(w, fmt.Sprintf("too many content encodings: %d", len(encodings)), http.StatusBadRequest)
+				return
+			}
+
+			body := http.MaxBytesReader(w, r.Body, maxSize)
+			for i := len(encodings) - 1; i >= 0; i-- {
+				inf, ok := byEncoding[encodings[i]]
+				if !ok {
+					http.Error(w, "unsupported content encoding "+encodings[i], http.StatusUnsupportedMediaType)
+					return
+				}
+
+				var err error
+				body, err = inf.wrap(body)
 				if err != nil {
-					http.Error(w, fmt.Sprintf("failed to decompress body: %v", err), http.StatusBadRequest)
+					unreadableBody(w, fmt.Errorf("failed to decompress body: %w", err))
 					return
 				}
-				r.Body = body
+				// the server only closes the body it received, and a decoder doesn't close the one it reads
+				defer body.Close()
+			}
+			if len(encodings) > 0 {
+				body = http.MaxBytesReader(w, body, maxDecompressedSize)
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+				r.ContentLength = -1
 			}
+			r.Body = body
 
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func newGzipInflator() func(next http.Handler) http.Handler {
-	return inflatorMiddleware(&gzipInflator{})
+// contentEncodings lists the codings in the order they were applied, skipping identity.
+func contentEncodings(values []string) []string {
+	var encodings []string
+	for _, v := range values {
+		for _, coding := range strings.Split(v, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			switch coding {
+			case "", "identity":
+				continue
+			case "x-gzip":
+				coding = "gzip"
+			}
+			encodings = append(encodings, coding)
+		}
+	}
+	return encodings
+}
+
+// unreadableBody answers 413 if the request body is over the limit and 400 otherwise.
+func unreadableBody(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("request body is too large, the limit is %d bytes", tooLarge.Limit),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	badRequest(w, err)
+}
+
+func newInflator(maxSize, maxDecompressedSize int64) func(next http.Handler) http.Handler {
+	return inflatorMiddleware(maxSize, maxDecompressedSize,
+		&gzipInflator{}, &deflateInflator{}, &brotliInflator{}, &zstdInflator{maxDecompressedSize})
 }
 
 type gzipInflator struct{}
 
-func (gi *gzipInflator) isCompressed(r *http.Request) bool {
-	return strings.Contains(r.Header.Get("Content-Encoding"), "gzip")
+func (gi *gzipInflator) encoding() string {
+	return "gzip"
 }
 
 func (gi *gzipInflator) wrap(rc io.ReadCloser) (io.ReadCloser, error) {
 	return gzip.NewReader(rc)
 }
+
+// deflateInflator reads the zlib format, which is what deflate means in HTTP.
+type deflateInflator struct{}
+
+func (di *deflateInflator) encoding() string {
+	return "deflate"
+}
+
+func (di *deflateInflator) wrap(rc io.ReadCloser) (io.ReadCloser, error) {
+	return zlib.NewReader(rc)
+}
+
+type brotliInflator struct{}
+
+func (bi *brotliInflator) encoding() string {
+	return "br"
+}
+
+func (bi *brotliInflator) wrap(rc io.ReadCloser) (io.ReadCloser, error) {
+	return io.NopCloser(brotli.NewReader(rc)), nil
+}
+
+type zstdInflator struct {
+	maxWindow int64
+}
+
+func (zi *zstdInflator) encoding() string {
+	return "zstd"
+}
+
+// The window is capped by the decompressed size limit so that a tiny frame
+// can't make the decoder allocate a huge buffer up front.
+func (zi *zstdInflator) wrap(rc io.ReadCloser) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxWindow(uint64(min(max(zi.maxWindow, zstd.MinWindowSize), zstd.MaxWindowSize))),
+		zstd.WithDecoderMaxMemory(uint64(zi.maxWindow)))
+	if err != nil {
+		return nil, err
+	}
+	return zstdReader{d.IOReadCloser(), zi.maxWindow}, nil
+}
+
+// zstdReader reports the frames too large for the decoder as the body being over the limit.
+type zstdReader struct {
+	io.ReadCloser
+	limit int64
+}
+
+func (zr zstdReader) Read(p []byte) (int, error) {
+	n, err := zr.ReadCloser.Read(p)
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		err = &http.MaxBytesError{Limit: zr.limit}
+	}
+	return n, err
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closingInflator counts the decoders closed.
+type closingInflator struct {
+	zstdInflator
+	closed *int
+}
+
+func (ci *closingInflator) wrap(rc io.ReadCloser) (io.ReadCloser, error) {
+	d, err := ci.zstdInflator.wrap(rc)
+	return countedCloser{d, ci.closed}, err
+}
+
+type countedCloser struct {
+	io.ReadCloser
+	closed *int
+}
+
+func (cc countedCloser) Close() error {
+	*cc.closed++
+	return cc.ReadCloser.Close()
+}
+
+func TestInflatorClosesDecoders(t *testing.T) {
+	closed := 0
+	inflate := inflatorMiddleware(1<<20, 1<<20, &closingInflator{zstdInflator{1 << 20}, &closed})
+	var body []byte
+	h := inflate(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		require.NoError(t, err)
+	}))
+
+	enc, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	payload := enc.EncodeAll(enc.EncodeAll([]byte("stacked"), nil), nil)
+
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+	r.Header.Set("Content-Encoding", "zstd, zstd")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equal(t, "stacked", string(body))
+	assert.Equal(t, 2, closed, "Decoders closed")
+}
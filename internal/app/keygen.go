@@ -1,5 +1,7 @@
 package app
 
+import "sync/atomic"
+
 type keyGenerator interface {
 	Generate(url string) shortKey
 }
@@ -11,6 +13,7 @@ type shortKey struct {
 
 type base62Generator struct {
 	counter chan uint64
+	last    *atomic.Uint64
 }
 
 func newBase62Generator(initial uint64) base62Generator {
@@ -18,7 +21,10 @@ func newBase62Generator(initial uint64) base62Generator {
 
 	go count(c, initial)
 
-	return base62Generator{c}
+	last := &atomic.Uint64{}
+	last.Store(initial - 1)
+
+	return base62Generator{c, last}
 }
 func count(counter chan uint64, initial uint64) {
 	for i := uint64(initial); ; i++ {
@@ -27,12 +33,19 @@ func count(counter chan uint64, initial uint64) {
 }
 func (g base62Generator) Generate(url string) shortKey {
 	uuid := <-g.counter
+	g.last.Store(uuid)
 
 	return shortKey{
 		uuid:     uuid,
 		shortURL: encode(uuid),
 	}
 }
+
+// position is the last generated uuid
+func (g base62Generator) position() uint64 {
+	return g.last.Load()
+}
+
 func encode(num uint64) string {
 	const base62 = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	const base = uint64(len(base62))
@@ -1,55 +1,113 @@
 package app
 
 import (
+	"context"
+	"crypto/rand"
+	"io"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/rs/zerolog"
 )
 
 type logger interface {
+	Debug(msg string, v ...any)
 	Info(msg string, v ...any)
+	Warn(msg string, v ...any)
 	Error(err error, msg string, v ...any)
+	// With returns a logger that adds the key-value pairs as fields of every message.
+	With(kv ...any) logger
 }
 
 type zeroLogger struct {
 	logger zerolog.Logger
 }
 
-func newZeroLogger() zeroLogger {
-	zl := zerolog.New(os.Stdout).With().Timestamp().Logger()
+func newZeroLogger(w io.Writer, level zerolog.Level) zeroLogger {
+	zl := zerolog.New(w).Level(level).With().Timestamp().Logger()
 
 	return zeroLogger{logger: zl}
 }
 
+func (zl zeroLogger) Debug(msg string, v ...any) {
+	zl.logger.Debug().Msgf(msg, v...)
+}
+
 func (zl zeroLogger) Info(msg string, v ...any) {
 	zl.logger.Info().Msgf(msg, v...)
 }
 
+func (zl zeroLogger) Warn(msg string, v ...any) {
+	zl.logger.Warn().Msgf(msg, v...)
+}
+
 func (zl zeroLogger) Error(err error, msg string, v ...any) {
 	zl.logger.Err(err).Msgf(msg, v...)
 }
 
-func loggingMiddleware(l logger) func(h http.Handler) http.Handler {
+func (zl zeroLogger) With(kv ...any) logger {
+	return zeroLogger{logger: zl.logger.With().Fields(kv).Logger()}
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, l logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// ctxLogger returns the logger of the request or the fallback outside of requests.
+func ctxLogger(ctx context.Context, fallback logger) logger {
+	if l, ok := ctx.Value(loggerKey{}).(logger); ok {
+		return l
+	}
+	return fallback
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDMiddleware keeps the request ID of the client or a proxy if it looks sane
+// and generates one otherwise. The ID is echoed in the response and logged with every message.
+func requestIDMiddleware(l logger) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(requestIDHeader)
+			if !validRequestID(id) {
+				id = rand.Text()
+			}
+			w.Header().Set(requestIDHeader, id)
+
+			ctx := withLogger(r.Context(), l.With("request_id", id))
+			h.ServeHTTP(w, r.WithContext(ctx))
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func loggingMiddleware(l logger, al accessLog) func(h http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		logFn := func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 
 			rw := loggingResponseWriter{
 				ResponseWriter: w,
+				status:         http.StatusOK,
 			}
 			h.ServeHTTP(&rw, r)
 
-			duration := time.Since(start)
-
-			l.Info("uri=%v, method=%v, status=%v, duration=%v, size=%v",
-				r.RequestURI,
-				r.Method,
-				rw.status,
-				duration,
-				rw.size,
-			)
+			al.write(ctxLogger(r.Context(), l), r, &rw, start)
 		}
 
 		return http.HandlerFunc(logFn)
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "shorturl"
+
+type httpMetrics struct {
+	requests  *prometheus.CounterVec
+	duration  *prometheus.HistogramVec
+	redirects *prometheus.CounterVec
+}
+
+func newHTTPMetrics(reg prometheus.Registerer) httpMetrics {
+	m := httpMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests per route, method and status.",
+		}, []string{"route", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests per route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		redirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "redirects_total",
+			Help:      "Number of redirect lookups per result: hit, miss, gone, blocked or flagged.",
+		}, []string{"result"}),
+	}
+	reg.MustRegister(m.requests, m.duration, m.redirects)
+
+	return m
+}
+
+// The route is the chi pattern rather than the request URI
+// so that the number of label values stays bounded.
+func metricsMiddleware(m httpMetrics) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			rw := loggingResponseWriter{
+				ResponseWriter: w,
+				status:         http.StatusOK,
+			}
+			h.ServeHTTP(&rw, r)
+
+			route := routePattern(r)
+			m.requests.WithLabelValues(route, r.Method, strconv.Itoa(rw.status)).Inc()
+			m.duration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// routePattern is only known after the router has matched the request.
+func routePattern(r *http.Request) string {
+	if route := chi.RouteContext(r.Context()).RoutePattern(); route != "" {
+		return route
+	}
+	return "unmatched"
+}
+
+// Responses are compressed by the deflator middleware.
+func metricsHandler(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg, DisableCompression: true})
+}
+
+func registerGauge(reg prometheus.Registerer, name, help string, labels prometheus.Labels, fn func() float64) {
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}, fn))
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// The reasons of InvalidURLError.
+const (
+	ReasonEmpty            = "empty"
+	ReasonTooLong          = "too_long"
+	ReasonMalformed        = "malformed"
+	ReasonNotAbsolute      = "not_absolute"
+	ReasonSchemeNotAllowed = "scheme_not_allowed"
+	ReasonInvalidHost      = "invalid_host"
+	ReasonDomainNotAllowed = "domain_not_allowed"
+	ReasonMalicious        = "malicious"
+)
+
+// InvalidURLError tells why the URL can't be shortened.
+type InvalidURLError struct {
+	Reason string
+	Detail string
+}
+
+func (e *InvalidURLError) Error() string {
+	return fmt.Sprintf("invalid url (%s): %s", e.Reason, e.Detail)
+}
+
+func (e *InvalidURLError) Unwrap() error {
+	return ErrInvalidRequest
+}
+
+func invalidURL(reason, format string, v ...any) error {
+	return &InvalidURLError{Reason: reason, Detail: fmt.Sprintf(format, v...)}
+}
+
+// urlPolicy validates the original URLs and brings them to a canonical form,
+// so that the equivalent ones get the same short key.
+type urlPolicy struct {
+	schemes   []string
+	maxLength int
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+func (up urlPolicy) normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case raw == "":
+		return "", invalidURL(ReasonEmpty, "no url given")
+	case len(raw) > up.maxLength:
+		return "", invalidURL(ReasonTooLong, "%d bytes is longer than %d", len(raw), up.maxLength)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", invalidURL(ReasonMalformed, "%v", err)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "" {
+		return "", invalidURL(ReasonNotAbsolute, "no scheme in %q", raw)
+	}
+	if !slices.Contains(up.schemes, scheme) {
+		return "", invalidURL(ReasonSchemeNotAllowed, "scheme %q is not one of %s", scheme, strings.Join(up.schemes, ", "))
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", invalidURL(ReasonNotAbsolute, "no host in %q", raw)
+	}
+
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", invalidURL(ReasonInvalidHost, "invalid port %q", port)
+		}
+		host += ":" + port
+	}
+
+	var b strings.Builder
+	b.WriteString(scheme + "://")
+	if u.User != nil {
+		b.WriteString(u.User.String() + "@")
+	}
+	b.WriteString(host)
+	if path := u.EscapedPath(); path != "" {
+		b.WriteString(canonicalEscapes(path))
+	} else {
+		b.WriteString("/")
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		b.WriteString("?" + canonicalEscapes(u.RawQuery))
+	}
+	if u.Fragment != "" {
+		b.WriteString("#" + canonicalEscapes(u.EscapedFragment()))
+	}
+
+	return b.String(), nil
+}
+
+// normalizeHost lowercases the domain names and converts the internationalized ones to punycode.
+func normalizeHost(host string) (string, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Is6() && !addr.Is4In6() {
+			return "[" + addr.String() + "]", nil
+		}
+		return addr.Unmap().String(), nil
+	}
+
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil || ascii == "" {
+		return "", invalidURL(ReasonInvalidHost, "invalid host %q", host)
+	}
+	return ascii, nil
+}
+
+// canonicalEscapes decodes the needlessly escaped unreserved characters, uppercases the hex digits
+// of the other escapes and escapes the bytes that can't appear in a URL as they are.
+func canonicalEscapes(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			decoded := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(decoded) {
+				b.WriteByte(decoded)
+			} else {
+				b.WriteString("%" + strings.ToUpper(s[i+1:i+3]))
+			}
+			i += 2
+		case c <= ' ' || c >= 0x7f || c == '%':
+			b.WriteString("%" + string(hex[c>>4]) + string(hex[c&15]))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// trailingPath is the part of the request path after the short key.
+func trailingPath(r *http.Request, key string) string {
+	return strings.TrimPrefix(r.URL.EscapedPath(), "/"+key)
+}
+
+// passThrough appends the trailing path of the request to the original URL
+// and adds the request query parameters to it. Parameters that the original URL
+// already has take precedence over the request ones with the same name.
+// The trailing path is cleaned beforehand so that it can't escape the original path.
+func passThrough(originalURL string, r *http.Request, key string) (string, error) {
+	u, err := url.Parse(originalURL)
+	if err != nil {
+		return "", err
+	}
+
+	if rest := trailingPath(r, key); rest != "" {
+		cleaned := path.Clean(rest)
+		if strings.HasSuffix(rest, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		u = u.JoinPath(cleaned)
+	}
+
+	q := u.Query()
+	extra := url.Values{}
+	for name, values := range r.URL.Query() {
+		if !q.Has(name) {
+			extra[name] = values
+		}
+	}
+	if len(extra) > 0 {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += extra.Encode()
+	}
+
+	return u.String(), nil
+}
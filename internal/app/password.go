@@ -0,0 +1,110 @@
+package app
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var passwordHashCost = bcrypt.DefaultCost
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	return string(hash), err
+}
+
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+const (
+	maxPasswordFailures = 5
+	passwordLockout     = 15 * time.Minute
+)
+
+// passwordAttempts locks a key out for a while after too many wrong passwords,
+// whichever clients guess them.
+type passwordAttempts struct {
+	mu       sync.Mutex
+	failures map[string]failedAttempts
+	swept    time.Time
+}
+
+type failedAttempts struct {
+	count int
+	since time.Time
+}
+
+func newPasswordAttempts() *passwordAttempts {
+	return &passwordAttempts{failures: make(map[string]failedAttempts)}
+}
+
+// reserve counts the attempt as failed before the password is compared,
+// so that the concurrent attempts can't get past the limit while bcrypt is busy.
+// The right password resets the count.
+func (pa *passwordAttempts) reserve(key string, now time.Time) error {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+
+	pa.sweep(now)
+	f, ok := pa.failures[key]
+	if retryIn := f.since.Add(passwordLockout).Sub(now); !ok || retryIn <= 0 {
+		f = failedAttempts{since: now}
+	} else if f.count >= maxPasswordFailures {
+		return fmt.Errorf("too many wrong passwords for key %v, retry in %v: %w",
+			key, retryIn.Round(time.Second), ErrTooManyAttempts)
+	}
+	f.count++
+	pa.failures[key] = f
+	return nil
+}
+
+// sweep forgets the attempts older than the lockout once per lockout,
+// so that the keys guessed only once don't pile up.
+func (pa *passwordAttempts) sweep(now time.Time) {
+	if now.Sub(pa.swept) < passwordLockout {
+		return
+	}
+	pa.swept = now
+	for key, f := range pa.failures {
+		if now.Sub(f.since) >= passwordLockout {
+			delete(pa.failures, key)
+		}
+	}
+}
+
+func (pa *passwordAttempts) reset(key string) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+
+	delete(pa.failures, key)
+}
+
+var passwordFormTmpl = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Password required</title>
+</head>
+<body>
+	<form method="post">
+		<p>This link is password protected.</p>
+		{{if .}}<p>{{.}}</p>{{end}}
+		<input type="password" name="password" autofocus required>
+		<button type="submit">Continue</button>
+	</form>
+</body>
+</html>
+`))
+
+func passwordForm(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	passwordFormTmpl.Execute(w, msg)
+}
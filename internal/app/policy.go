@@ -0,0 +1,227 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// domainPolicy decides which hosts can be shortened and followed.
+// The rules are read from a file, one per line:
+//
+//	# comment
+//	allow example.com         exact host
+//	allow *.example.com       any subdomain
+//	deny /^login-.*\.net$/    regular expression matched against the host
+//	deny 192.0.2.0/24         CIDR matched against the IP literal hosts
+//
+// A host matching a deny rule is blocked. If there are allow rules,
+// a host is blocked unless it matches one of them, too.
+// The file is reloaded when it changes.
+type domainPolicy struct {
+	path  string
+	rules *atomic.Pointer[policyRules]
+	log   logger
+}
+
+type policyRules struct {
+	allow, deny hostMatcher
+	modTime     time.Time
+	size        int64
+}
+
+type hostMatcher struct {
+	exact    map[string]bool
+	suffixes []string
+	regexps  []*regexp.Regexp
+	prefixes []netip.Prefix
+}
+
+const policyReloadInterval = 5 * time.Second
+
+// The file is watched until the context is done.
+func newDomainPolicy(ctx context.Context, path string, log logger) (*domainPolicy, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	dp := &domainPolicy{path, &atomic.Pointer[policyRules]{}, log}
+	rules, err := loadPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	dp.rules.Store(rules)
+
+	go every(ctx, policyReloadInterval, dp.watch)
+
+	return dp, nil
+}
+
+// allows is true for any URL without a policy.
+func (dp *domainPolicy) allows(originalURL string) bool {
+	if dp == nil {
+		return true
+	}
+
+	u, err := url.Parse(originalURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	rules := dp.rules.Load()
+	if rules.deny.matches(host) {
+		return false
+	}
+	return rules.allow.empty() || rules.allow.matches(host)
+}
+
+// watch reloads the policy when the file changes.
+// A broken file is reported and the last good policy stays in effect.
+func (dp *domainPolicy) watch(context.Context, time.Time) {
+	reloaded, err := dp.reload()
+	if err != nil {
+		dp.log.Error(err, "reloading domain policy")
+	} else if reloaded {
+		dp.log.Info("reloaded domain policy from %s", dp.path)
+	}
+}
+
+// reload reads the file again if its modification time or size has changed.
+func (dp *domainPolicy) reload() (bool, error) {
+	fi, err := os.Stat(dp.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat domain policy: %w", err)
+	}
+
+	current := dp.rules.Load()
+	if fi.ModTime().Equal(current.modTime) && fi.Size() == current.size {
+		return false, nil
+	}
+
+	rules, err := loadPolicy(dp.path)
+	if err != nil {
+		return false, err
+	}
+	dp.rules.Store(rules)
+	return true, nil
+}
+
+func loadPolicy(path string) (*policyRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open domain policy: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat domain policy: %w", err)
+	}
+
+	rules := &policyRules{allow: newHostMatcher(), deny: newHostMatcher(), modTime: fi.ModTime(), size: fi.Size()}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		action, pattern, _ := strings.Cut(line, " ")
+		var m *hostMatcher
+		switch action {
+		case "allow":
+			m = &rules.allow
+		case "deny":
+			m = &rules.deny
+		default:
+			return nil, fmt.Errorf("domain policy line %d: unknown action %q", n, action)
+		}
+		if err := m.add(strings.TrimSpace(pattern)); err != nil {
+			return nil, fmt.Errorf("domain policy line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read domain policy: %w", err)
+	}
+
+	return rules, nil
+}
+
+func newHostMatcher() hostMatcher {
+	return hostMatcher{exact: make(map[string]bool)}
+}
+
+func (m *hostMatcher) add(pattern string) error {
+	switch {
+	case pattern == "":
+		return fmt.Errorf("missing pattern")
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return fmt.Errorf("invalid regexp %s: %w", pattern, err)
+		}
+		m.regexps = append(m.regexps, re)
+	case strings.Contains(pattern, "/"):
+		prefix, err := netip.ParsePrefix(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %s: %w", pattern, err)
+		}
+		m.prefixes = append(m.prefixes, prefix.Masked())
+	case strings.HasPrefix(pattern, "*."):
+		suffix, err := idna.Lookup.ToASCII(pattern[2:])
+		if err != nil {
+			return fmt.Errorf("invalid domain %s: %w", pattern, err)
+		}
+		m.suffixes = append(m.suffixes, "."+suffix)
+	default:
+		if addr, err := netip.ParseAddr(pattern); err == nil {
+			m.prefixes = append(m.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			return nil
+		}
+		host, err := idna.Lookup.ToASCII(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid domain %s: %w", pattern, err)
+		}
+		m.exact[host] = true
+	}
+	return nil
+}
+
+func (m hostMatcher) empty() bool {
+	return len(m.exact) == 0 && len(m.suffixes) == 0 && len(m.regexps) == 0 && len(m.prefixes) == 0
+}
+
+func (m hostMatcher) matches(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		for _, p := range m.prefixes {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+	} else if m.exact[host] {
+		return true
+	}
+
+	for _, s := range m.suffixes {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
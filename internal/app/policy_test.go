@@ -0,0 +1,101 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePolicy(t *testing.T, path, rules string) {
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0666))
+}
+
+func TestDomainPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	writePolicy(t, path, `
+# our own domains only
+allow example.com
+allow *.example.org
+allow /^go[a-z]*\.dev$/
+allow 192.0.2.0/24
+allow Bücher.example
+
+deny phishing.example.org
+deny 192.0.2.66
+`)
+	dp, err := newDomainPolicy(t.Context(), path, testLogger{t: t})
+	require.NoError(t, err)
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://example.com/", true},
+		{"https://www.example.com/", false},
+		{"https://docs.example.org/", true},
+		{"https://example.org/", false},
+		{"https://phishing.example.org/login", false},
+		{"https://pkg.go.dev/cmp", false},
+		{"https://golang.dev/", true},
+		{"https://go.dev.evil.example/", false},
+		{"http://192.0.2.1:8080/", true},
+		{"http://192.0.2.66/", false},
+		{"http://[::ffff:192.0.2.1]/", true},
+		{"https://xn--bcher-kva.example/", true},
+		{"https://evil.example/", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, dp.allows(tt.url), tt.url)
+	}
+}
+
+func TestDomainPolicyWithoutAllowRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	writePolicy(t, path, "deny *.evil.example\n")
+	dp, err := newDomainPolicy(t.Context(), path, testLogger{t: t})
+	require.NoError(t, err)
+
+	assert.True(t, dp.allows("https://pkg.go.dev/cmp"))
+	assert.False(t, dp.allows("https://www.evil.example/"))
+
+	var none *domainPolicy
+	assert.True(t, none.allows("https://www.evil.example/"), "Without a policy")
+}
+
+func TestDomainPolicyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	writePolicy(t, path, "deny evil.example\n")
+	dp, err := newDomainPolicy(t.Context(), path, testLogger{t: t})
+	require.NoError(t, err)
+
+	reloaded, err := dp.reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded, "Reload of the same file")
+
+	writePolicy(t, path, "deny pkg.go.dev\n# the other one is fine now\n")
+	reloaded, err = dp.reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded, "Reload of the changed file")
+	assert.True(t, dp.allows("https://evil.example/"))
+	assert.False(t, dp.allows("https://pkg.go.dev/cmp"))
+
+	writePolicy(t, path, "block everything\n")
+	_, err = dp.reload()
+	assert.ErrorContains(t, err, "line 1")
+	assert.False(t, dp.allows("https://pkg.go.dev/cmp"), "Last good policy")
+}
+
+func TestInvalidDomainPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	for _, rules := range []string{"deny /(/", "allow 10.0.0.0/33", "deny", "allow exa_mple.com"} {
+		writePolicy(t, path, rules)
+		_, err := newDomainPolicy(t.Context(), path, testLogger{t: t})
+		assert.Error(t, err, rules)
+	}
+
+	_, err := newDomainPolicy(t.Context(), filepath.Join(t.TempDir(), "missing"), testLogger{t: t})
+	assert.Error(t, err)
+}
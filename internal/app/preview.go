@@ -0,0 +1,86 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const previewTemplateName = "preview.html"
+
+// The built-in preview page links to the short URL rather than to the destination,
+// so that following it goes through the usual password and threat checks.
+const defaultPreviewTemplate = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Link preview</title>
+</head>
+<body>
+	<h1>Where does {{.ShortURL}} go?</h1>
+	{{if .Protected}}
+	<p>This link is password protected, its destination is shown once the password is given.</p>
+	{{else}}
+	{{if .Flagged}}<p><strong>Warning:</strong> the destination is on a list of phishing and malware sites.</p>{{end}}
+	<p><code>{{.OriginalURL}}</code></p>
+	{{end}}
+	<dl>
+		<dt>Created</dt>
+		<dd>{{if .CreatedAt.IsZero}}unknown{{else}}{{.CreatedAt.UTC.Format "2006-01-02 15:04 MST"}}{{end}}</dd>
+		<dt>Clicks</dt>
+		<dd>{{.Clicks}}</dd>
+	</dl>
+	<p><a href="{{.ShortURL}}" rel="nofollow">Continue</a></p>
+</body>
+</html>
+`
+
+// loadPreviewTemplate prefers preview.html of the templates directory to the built-in page.
+// Either way the template is parsed as HTML, so the stored URLs are escaped.
+func loadPreviewTemplate(dir string) (*template.Template, error) {
+	text := defaultPreviewTemplate
+	if dir != "" {
+		b, err := os.ReadFile(filepath.Join(dir, previewTemplateName))
+		if err == nil {
+			text = string(b)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read preview template: %w", err)
+		}
+	}
+
+	tmpl, err := template.New(previewTemplateName).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid preview template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// previewKey recognizes the /{key}+ and /{key}?preview=1 requests.
+// The keys are base62, so the plus sign can't be a part of them.
+func previewKey(r *http.Request, key string) (string, bool) {
+	if k, ok := strings.CutSuffix(key, "+"); ok {
+		return k, true
+	}
+	return key, r.URL.Query().Get("preview") == "1"
+}
+
+// previewPage is rendered to a buffer first, so that a broken custom template
+// fails with 500 rather than a truncated page.
+func previewPage(w http.ResponseWriter, tmpl *template.Template, p LinkPreview) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, p); err != nil {
+		return fmt.Errorf("failed to render preview: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+	return nil
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviewKey(t *testing.T) {
+	tests := []struct {
+		target  string
+		key     string
+		want    string
+		preview bool
+	}{
+		{"/aaaaab+", "aaaaab+", "aaaaab", true},
+		{"/aaaaab?preview=1", "aaaaab", "aaaaab", true},
+		{"/aaaaab?preview=0", "aaaaab", "aaaaab", false},
+		{"/aaaaab", "aaaaab", "aaaaab", false},
+	}
+	for _, tt := range tests {
+		key, preview := previewKey(httptest.NewRequest("GET", tt.target, nil), tt.key)
+		assert.Equal(t, tt.want, key, tt.target)
+		assert.Equal(t, tt.preview, preview, tt.target)
+	}
+}
+
+func TestLoadPreviewTemplate(t *testing.T) {
+	tmpl, err := loadPreviewTemplate("")
+	require.NoError(t, err)
+	assert.Equal(t, previewTemplateName, tmpl.Name())
+
+	dir := t.TempDir()
+	_, err = loadPreviewTemplate(dir)
+	assert.NoError(t, err, "Built-in template without preview.html")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, previewTemplateName), []byte("{{.ShortURL"), 0666))
+	_, err = loadPreviewTemplate(dir)
+	assert.ErrorContains(t, err, "invalid preview template")
+}
+
+func TestPreviewPageFailure(t *testing.T) {
+	tmpl, err := loadPreviewTemplate("")
+	require.NoError(t, err)
+	_, err = tmpl.New(previewTemplateName).Parse("{{.Missing}}")
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	assert.Error(t, previewPage(w, tmpl, LinkPreview{}))
+	assert.Empty(t, w.Body.String(), "Nothing written on failure")
+}
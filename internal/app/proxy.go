@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies reads a comma separated list of CIDRs or single addresses.
+func parseTrustedProxies(list string) (trustedProxies, error) {
+	var tp trustedProxies
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		tp = append(tp, prefix.Masked())
+	}
+	return tp, nil
+}
+
+func (tp trustedProxies) trusts(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range tp {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type clientKey struct{}
+
+// client is where the request came from before it passed through the trusted proxies.
+type client struct {
+	ip     string
+	scheme string
+}
+
+// proxyMiddleware resolves the client of the request from the forwarding headers
+// set by the trusted proxies. The headers of anybody else are ignored,
+// since they are as easy to forge as to send.
+func proxyMiddleware(tp trustedProxies) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := tp.resolve(r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, c)))
+		})
+	}
+}
+
+// resolve walks the proxy chain from the nearest hop back to the first one that is not trusted.
+func (tp trustedProxies) resolve(r *http.Request) client {
+	c := client{ip: remoteIP(r), scheme: "http"}
+	if r.TLS != nil {
+		c.scheme = "https"
+	}
+
+	addr, err := netip.ParseAddr(c.ip)
+	if err != nil || !tp.trusts(addr) {
+		return c
+	}
+
+	hops := forwardedHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseNode(hops[i].node)
+		if !ok {
+			break // an unknown or obfuscated client is represented by the proxy
+		}
+		c.ip = addr.Unmap().String()
+		if hops[i].proto == "http" || hops[i].proto == "https" {
+			c.scheme = hops[i].proto
+		}
+		if !tp.trusts(addr) {
+			break
+		}
+	}
+	return c
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// hop is an element of the forwarding chain, the client first.
+type hop struct {
+	node  string
+	proto string
+}
+
+// forwardedHops prefers the standard Forwarded header to the X-Forwarded ones.
+func forwardedHops(h http.Header) []hop {
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		return parseForwarded(values)
+	}
+
+	var hops []hop
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, node := range strings.Split(v, ",") {
+			hops = append(hops, hop{node: strings.TrimSpace(node)})
+		}
+	}
+
+	var protos []string
+	for _, v := range h.Values("X-Forwarded-Proto") {
+		for _, proto := range strings.Split(v, ",") {
+			protos = append(protos, strings.ToLower(strings.TrimSpace(proto)))
+		}
+	}
+	if len(protos) == len(hops) {
+		for i := range hops {
+			hops[i].proto = protos[i]
+		}
+	} else if len(hops) > 0 && len(protos) > 0 {
+		// the proxies that overwrite the header rather than append to it
+		hops[len(hops)-1].proto = protos[len(protos)-1]
+	}
+
+	return hops
+}
+
+// parseForwarded reads the for and proto parameters of the RFC 7239 header elements.
+func parseForwarded(values []string) []hop {
+	var hops []hop
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			var h hop
+			for _, pair := range splitQuoted(element, ';') {
+				name, value, _ := strings.Cut(pair, "=")
+				value = strings.Trim(strings.TrimSpace(value), `"`)
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "for":
+					h.node = value
+				case "proto":
+					h.proto = strings.ToLower(value)
+				}
+			}
+			hops = append(hops, h)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits the string by the separator outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNode accepts the addresses with or without a port, the IPv6 ones in brackets.
+func parseNode(node string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(node); err == nil {
+		return addr, true
+	}
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr(), true
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")); err == nil {
+		return addr, true
+	}
+	return netip.Addr{}, false
+}
+
+// clientIP is the address of the client as resolved by the proxy middleware.
+func clientIP(r *http.Request) string {
+	if c, ok := r.Context().Value(clientKey{}).(client); ok {
+		return c.ip
+	}
+	return remoteIP(r)
+}
+
+// requestScheme is the scheme the client used to reach the first trusted proxy.
+func requestScheme(r *http.Request) string {
+	if c, ok := r.Context().Value(clientKey{}).(client); ok {
+		return c.scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveClient(t *testing.T) {
+	tp, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, fd00::/8")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		remote   string
+		header   http.Header
+		expected client
+	}{
+		{"direct", "203.0.113.7:1234", nil, client{"203.0.113.7", "http"}},
+		{"untrusted proxy", "203.0.113.7:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Proto": {"https"}},
+			client{"203.0.113.7", "http"}},
+		{"trusted proxy", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Proto": {"https"}},
+			client{"198.51.100.1", "https"}},
+		{"forged hop", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 192.168.1.1"}},
+			client{"198.51.100.1", "http"}},
+		{"header lines", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1"}, "X-Forwarded-Proto": {"http", "https"}},
+			client{"198.51.100.1", "https"}},
+		{"all trusted", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"10.1.1.1, 10.2.2.2"}},
+			client{"10.1.1.1", "http"}},
+		{"no header", "10.0.0.1:1234", nil, client{"10.0.0.1", "http"}},
+		{"garbage", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"not an ip"}},
+			client{"10.0.0.1", "http"}},
+		{"forwarded", "10.0.0.1:1234",
+			http.Header{"Forwarded": {`for=198.51.100.1;proto=https, for="[fd00::1]:4711";proto=http`}},
+			client{"198.51.100.1", "https"}},
+		{"forwarded ipv6", "[fd00::2]:1234",
+			http.Header{"Forwarded": {`For="[2001:db8:cafe::17]:4711"`}},
+			client{"2001:db8:cafe::17", "http"}},
+		{"forwarded obfuscated", "10.0.0.1:1234",
+			http.Header{"Forwarded": {"for=_hidden, for=unknown"}},
+			client{"10.0.0.1", "http"}},
+		{"forwarded wins", "10.0.0.1:1234",
+			http.Header{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"198.51.100.2"}},
+			client{"198.51.100.1", "http"}},
+		{"mapped ipv4", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"::ffff:198.51.100.1"}},
+			client{"198.51.100.1", "http"}},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		for name, values := range tt.header {
+			r.Header[name] = values
+		}
+
+		assert.Equal(t, tt.expected, tp.resolve(r), tt.name)
+	}
+}
+
+func TestResolveTLS(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{}
+
+	assert.Equal(t, "https", trustedProxies{}.resolve(r).scheme)
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tp, err := parseTrustedProxies("")
+	assert.NoError(t, err)
+	assert.Empty(t, tp)
+
+	_, err = parseTrustedProxies("10.0.0.0/8,localhost")
+	assert.Error(t, err)
+}
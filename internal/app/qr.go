@@ -0,0 +1,127 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+
+	// the image of a key never changes, but the link may be gone tomorrow
+	qrMaxAge = 24 * time.Hour
+)
+
+// The error correction levels by their names in the QR code specification.
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+type qrOptions struct {
+	size   int // pixels of the PNG image, or the width and height of the SVG one
+	level  qrcode.RecoveryLevel
+	format string
+}
+
+// parseQROptions reads the size, level and format query parameters,
+// which default to 256 pixels, level M and PNG.
+func parseQROptions(q url.Values) (qrOptions, error) {
+	opts := qrOptions{size: defaultQRSize, level: qrcode.Medium, format: "png"}
+
+	if s := q.Get("size"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			return opts, fmt.Errorf("size %s is not between %d and %d: %w", s, minQRSize, maxQRSize, ErrInvalidRequest)
+		}
+		opts.size = size
+	}
+	if s := q.Get("level"); s != "" {
+		level, ok := qrLevels[strings.ToUpper(s)]
+		if !ok {
+			return opts, fmt.Errorf("level %s is not one of L, M, Q or H: %w", s, ErrInvalidRequest)
+		}
+		opts.level = level
+	}
+	if s := q.Get("format"); s != "" {
+		opts.format = strings.ToLower(s)
+		if opts.format != "png" && opts.format != "svg" {
+			return opts, fmt.Errorf("format %s is not png or svg: %w", s, ErrInvalidRequest)
+		}
+	}
+	return opts, nil
+}
+
+// qrImage encodes the content and returns the image with its content type.
+func qrImage(content string, opts qrOptions) ([]byte, string, error) {
+	q, err := qrcode.New(content, opts.level)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode qr code: %w", err)
+	}
+
+	if opts.format == "svg" {
+		return qrSVG(q.Bitmap(), opts.size), "image/svg+xml", nil
+	}
+	b, err := q.PNG(opts.size)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to render qr code: %w", err)
+	}
+	return b, "image/png", nil
+}
+
+// qrSVG draws the modules of the bitmap, quiet zone included,
+// as a single path of the horizontal runs of each row.
+func qrSVG(bitmap [][]bool, size int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, len(bitmap), len(bitmap))
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			run := 1
+			for x+run < len(row) && row[x+run] {
+				run++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", x, y, run, run)
+			x += run
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+// qrURL is the address of the QR code of the short URL.
+func qrURL(shortURL string) string {
+	if shortURL == "" {
+		return ""
+	}
+	return shortURL + "/qr"
+}
+
+// serveQR lets the clients and proxies cache the image and revalidate it with the ETag.
+func serveQR(w http.ResponseWriter, r *http.Request, image []byte, contentType string) {
+	sum := sha256.Sum256(image)
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(qrMaxAge.Seconds())))
+	h.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(image))
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"bytes"
+	"image/png"
+	"net/url"
+	"testing"
+
+	"github.com/skip2/go-qrcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQROptions(t *testing.T) {
+	tests := []struct {
+		query string
+		want  qrOptions
+		err   bool
+	}{
+		{"", qrOptions{defaultQRSize, qrcode.Medium, "png"}, false},
+		{"size=512&level=h&format=SVG", qrOptions{512, qrcode.Highest, "svg"}, false},
+		{"level=Q", qrOptions{defaultQRSize, qrcode.High, "png"}, false},
+		{"size=32", qrOptions{}, true},
+		{"size=2048", qrOptions{}, true},
+		{"size=big", qrOptions{}, true},
+		{"level=X", qrOptions{}, true},
+		{"format=gif", qrOptions{}, true},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		require.NoError(t, err)
+
+		opts, err := parseQROptions(q)
+		if tt.err {
+			assert.ErrorIs(t, err, ErrInvalidRequest, tt.query)
+		} else if assert.NoError(t, err, tt.query) {
+			assert.Equal(t, tt.want, opts, tt.query)
+		}
+	}
+}
+
+func TestQRImage(t *testing.T) {
+	b, contentType, err := qrImage("http://localhost:8080/aaaaab", qrOptions{300, qrcode.Medium, "png"})
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+	img, err := png.Decode(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx(), "Width")
+	assert.Equal(t, 300, img.Bounds().Dy(), "Height")
+
+	b, contentType, err = qrImage("http://localhost:8080/aaaaab", qrOptions{300, qrcode.Medium, "svg"})
+	require.NoError(t, err)
+	assert.Equal(t, "image/svg+xml", contentType)
+	assert.Contains(t, string(b), `width="300" height="300"`)
+}
+
+func TestQRSVG(t *testing.T) {
+	bitmap := [][]bool{
+		{true, true, false},
+		{false, true, true},
+		{true, false, true},
+	}
+	assert.Equal(t, `<svg xmlns="http://www.w3.org/2000/svg" width="90" height="90" viewBox="0 0 3 3" shape-rendering="crispEdges">`+
+		`<rect width="100%" height="100%" fill="#fff"/>`+
+		`<path fill="#000" d="M0 0h2v1h-2zM1 1h2v1h-2zM0 2h1v1h-1zM2 2h1v1h-1z"/></svg>`,
+		string(qrSVG(bitmap, 90)))
+}
@@ -0,0 +1,295 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rateLimit is a token bucket holding up to limit tokens and refilled with limit tokens every period.
+// The zero value doesn't limit anything.
+type rateLimit struct {
+	limit  int
+	period time.Duration
+}
+
+var ratePeriods = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+// parseRateLimit reads limits like 100/m, where the unit is one of s, m or h; 0 disables the limit.
+func parseRateLimit(s string) (rateLimit, error) {
+	if s == "0" {
+		return rateLimit{}, nil
+	}
+
+	count, unit, _ := strings.Cut(s, "/")
+	limit, err := strconv.Atoi(count)
+	period, ok := ratePeriods[unit]
+	if err != nil || limit <= 0 || !ok {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %s", s)
+	}
+	return rateLimit{limit, period}, nil
+}
+
+func (rl rateLimit) enabled() bool {
+	return rl.limit > 0
+}
+
+func (rl rateLimit) tokensPerSecond() float64 {
+	return float64(rl.limit) / rl.period.Seconds()
+}
+
+func (rl rateLimit) refill(tokens float64, elapsed time.Duration) float64 {
+	return min(float64(rl.limit), tokens+elapsed.Seconds()*rl.tokensPerSecond())
+}
+
+// decision describes the bucket left with the given number of tokens.
+func (rl rateLimit) decision(tokens float64, allowed bool) rateDecision {
+	d := rateDecision{
+		allowed:   allowed,
+		limit:     rl.limit,
+		remaining: int(tokens),
+		reset:     seconds((float64(rl.limit) - tokens) / rl.tokensPerSecond()),
+	}
+	if !allowed {
+		d.retryAfter = max(1, seconds((1-tokens)/rl.tokensPerSecond()))
+	}
+	return d
+}
+
+func seconds(s float64) int {
+	return int(math.Ceil(s))
+}
+
+type rateDecision struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      int // seconds until the bucket is full
+	retryAfter int // seconds until the next token if not allowed
+}
+
+// rateLimiter takes a token from the bucket of the key.
+type rateLimiter interface {
+	take(ctx context.Context, key string, rl rateLimit) (rateDecision, error)
+	close() error
+}
+
+type rateLimits struct {
+	limiter  rateLimiter
+	shorten  rateLimit
+	redirect rateLimit
+	admin    string // token of the client with a budget of its own wherever it calls from
+	log      logger
+	rejected *prometheus.CounterVec
+}
+
+func newRateLimits(cfg config) (rateLimits, error) {
+	rls := rateLimits{
+		shorten:  cfg.shortenRateLimit,
+		redirect: cfg.redirectRateLimit,
+		admin:    cfg.adminToken,
+		log:      cfg.log,
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rate_limited_requests_total",
+			Help:      "Number of requests rejected by the rate limits per budget: shorten or redirect.",
+		}, []string{"budget"}),
+	}
+	if !rls.shorten.enabled() && !rls.redirect.enabled() {
+		return rls, nil
+	}
+	cfg.metrics.MustRegister(rls.rejected)
+
+	// A bucket left alone for the longest period is full and can be forgotten.
+	idle := max(rls.shorten.period, rls.redirect.period)
+	if cfg.rateLimitStore == "postgres" {
+		pl, err := newPgRateLimiter(cfg)
+		if err != nil {
+			return rls, err
+		}
+		go every(cfg.background, idle, pl.sweep(idle))
+		rls.limiter = pl
+	} else {
+		ml := newMemRateLimiter()
+		go every(cfg.background, idle, ml.sweep)
+		rls.limiter = ml
+	}
+
+	return rls, nil
+}
+
+// middleware answers 429 once the client has spent the budget.
+func (rls rateLimits) middleware(budget string, rl rateLimit) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !rl.enabled() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d, err := rls.limiter.take(r.Context(), budget+":"+rls.key(r), rl)
+			if err != nil {
+				// better let the clients in than lock everybody out while the database is down
+				ctxLogger(r.Context(), rls.log).Error(err, "rate limiting %s", r.URL.Path)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(d.limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(d.reset))
+			if !d.allowed {
+				rls.rejected.WithLabelValues(budget).Inc()
+				h.Set("Retry-After", strconv.Itoa(d.retryAfter))
+				http.Error(w, fmt.Sprintf("rate limit exceeded, retry in %d seconds", d.retryAfter),
+					http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// There are no user accounts, so the clients are told apart by their IP,
+// except for the admin authenticated with the token.
+func (rls rateLimits) key(r *http.Request) string {
+	if rls.admin != "" && hasBearerToken(r, rls.admin) {
+		return "admin"
+	}
+	return "ip:" + clientIP(r)
+}
+
+// close releases the limiter once the server is shut down.
+func (rls rateLimits) close(context.Context) error {
+	if rls.limiter == nil {
+		return nil
+	}
+	return rls.limiter.close()
+}
+
+type tokenBucket struct {
+	tokens float64
+	at     int64 // unix nanoseconds of the last take
+	fullAt int64
+}
+
+// memRateLimiter keeps the buckets of a single instance.
+type memRateLimiter struct {
+	buckets shardedMap[tokenBucket]
+}
+
+func newMemRateLimiter() memRateLimiter {
+	return memRateLimiter{newShardedMap(func(key string, _ tokenBucket) int64 {
+		return int64(len(key)) + 24
+	})}
+}
+
+func (ml memRateLimiter) take(_ context.Context, key string, rl rateLimit) (rateDecision, error) {
+	now := time.Now().UnixNano()
+
+	var allowed bool
+	b := ml.buckets.Compute(key, func(old tokenBucket, loaded bool) tokenBucket {
+		tokens := float64(rl.limit)
+		if loaded {
+			tokens = rl.refill(old.tokens, time.Duration(now-old.at))
+		}
+		if allowed = tokens >= 1; allowed {
+			tokens--
+		}
+		refillTime := (float64(rl.limit) - tokens) / rl.tokensPerSecond()
+		return tokenBucket{tokens, now, now + int64(refillTime*float64(time.Second))}
+	})
+
+	return rl.decision(b.tokens, allowed), nil
+}
+
+func (ml memRateLimiter) close() error {
+	return nil
+}
+
+// sweep forgets the full buckets, which are no different from the missing ones.
+func (ml memRateLimiter) sweep(_ context.Context, now time.Time) {
+	ml.buckets.DeleteFunc(func(_ string, b tokenBucket) bool {
+		return b.fullAt <= now.UnixNano()
+	})
+}
+
+// pgRateLimiter shares the buckets between the instances using the same database.
+// It creates its table itself, as the rate limits don't depend on where the links are stored.
+type pgRateLimiter struct {
+	db  *sql.DB
+	log logger
+}
+
+const createRateLimitsTable = `
+CREATE TABLE IF NOT EXISTS rate_limits (
+	key TEXT PRIMARY KEY,
+	tokens DOUBLE PRECISION NOT NULL,
+	allowed BOOLEAN NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);`
+
+func newPgRateLimiter(cfg config) (pgRateLimiter, error) {
+	if !strings.HasPrefix(cfg.dbDsn, "postgresql") {
+		return pgRateLimiter{}, fmt.Errorf("shared rate limits need a postgresql database")
+	}
+
+	db, err := sql.Open("pgx", cfg.dbDsn)
+	if err != nil {
+		return pgRateLimiter{}, err
+	}
+	if _, err = db.ExecContext(context.Background(), createRateLimitsTable); err != nil {
+		db.Close()
+		return pgRateLimiter{}, fmt.Errorf("failed to create rate limits table: %w", err)
+	}
+
+	return pgRateLimiter{db, cfg.log}, nil
+}
+
+func (pl pgRateLimiter) close() error {
+	return pl.db.Close()
+}
+
+// The upsert locks the row of the key, so concurrent takes of all instances are serialized.
+// The expressions of SET see the row as it was before the update.
+func (pl pgRateLimiter) take(ctx context.Context, key string, rl rateLimit) (rateDecision, error) {
+	const query = `
+		INSERT INTO rate_limits AS rl (key, tokens, allowed, updated_at)
+		VALUES ($1, $2::float8 - 1, TRUE, now())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = LEAST($2::float8, rl.tokens + EXTRACT(EPOCH FROM now() - rl.updated_at) * $3::float8)
+				- CASE WHEN LEAST($2::float8, rl.tokens + EXTRACT(EPOCH FROM now() - rl.updated_at) * $3::float8) >= 1
+					THEN 1 ELSE 0 END,
+			allowed = LEAST($2::float8, rl.tokens + EXTRACT(EPOCH FROM now() - rl.updated_at) * $3::float8) >= 1,
+			updated_at = now()
+		RETURNING tokens, allowed
+	`
+	var (
+		tokens  float64
+		allowed bool
+	)
+	err := pl.db.QueryRowContext(ctx, query, key, rl.limit, rl.tokensPerSecond()).Scan(&tokens, &allowed)
+	if err != nil {
+		return rateDecision{}, fmt.Errorf("failed to take a token: %w", err)
+	}
+	return rl.decision(tokens, allowed), nil
+}
+
+// sweep forgets the buckets left alone for the idle period.
+func (pl pgRateLimiter) sweep(idle time.Duration) func(ctx context.Context, now time.Time) {
+	const query = "DELETE FROM rate_limits WHERE updated_at < now() - make_interval(secs => $1)"
+
+	return func(ctx context.Context, _ time.Time) {
+		if _, err := pl.db.ExecContext(ctx, query, idle.Seconds()); err != nil {
+			pl.log.Error(err, "sweeping rate limits")
+		}
+	}
+}
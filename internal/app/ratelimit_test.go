@@ -0,0 +1,70 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected rateLimit
+		valid    bool
+	}{
+		{"0", rateLimit{}, true},
+		{"100/m", rateLimit{100, time.Minute}, true},
+		{"5/s", rateLimit{5, time.Second}, true},
+		{"1000/h", rateLimit{1000, time.Hour}, true},
+		{"100", rateLimit{}, false},
+		{"-1/s", rateLimit{}, false},
+		{"10/d", rateLimit{}, false},
+		{"", rateLimit{}, false},
+	}
+
+	for _, tt := range tests {
+		rl, err := parseRateLimit(tt.in)
+		if tt.valid {
+			assert.NoError(t, err, tt.in)
+			assert.Equal(t, tt.expected, rl, tt.in)
+		} else {
+			assert.Error(t, err, tt.in)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	ml := newMemRateLimiter()
+	rl := rateLimit{10, time.Second}
+
+	for i := range 10 {
+		d, err := ml.take(context.Background(), "client", rl)
+		require.NoError(t, err)
+		assert.True(t, d.allowed, "Take %d", i)
+		assert.Equal(t, 9-i, d.remaining, "Remaining after take %d", i)
+	}
+
+	d, _ := ml.take(context.Background(), "client", rl)
+	assert.False(t, d.allowed, "Take of an empty bucket")
+	assert.Equal(t, 1, d.retryAfter, "Retry after")
+	assert.Equal(t, 1, d.reset, "Reset")
+
+	d, _ = ml.take(context.Background(), "other client", rl)
+	assert.True(t, d.allowed, "Take of another client")
+
+	time.Sleep(150 * time.Millisecond)
+	d, _ = ml.take(context.Background(), "client", rl)
+	assert.True(t, d.allowed, "Take of a refilled token")
+}
+
+func TestSharedRateLimitsNeedPostgres(t *testing.T) {
+	cfg, err := newConfig(WithLogger(testLogger{t: t}), WithMemoryStorage(),
+		WithShortenRateLimit("10/m"), WithRateLimitStore("postgres"))
+	require.NoError(t, err)
+
+	_, err = newRateLimits(cfg)
+	assert.ErrorContains(t, err, "need a postgresql database")
+}
@@ -2,21 +2,69 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 )
 
 type service interface {
-	CreateShortURL(ctx context.Context, url string) (shortURL string, err error)
-	LookUp(ctx context.Context, key string) (url string, err error)
+	CreateShortURL(ctx context.Context, url string, opts LinkOptions) (shortURL string, err error)
+	LookUp(ctx context.Context, key string) (link, error)
+	Unlock(ctx context.Context, key, password string) (link, error)
+	ConsumeClick(ctx context.Context, l link) (link, error)
+	RecordClick(c click)
+	// Flush persists the buffered clicks and visitors, e.g. on shutdown.
+	Flush(ctx context.Context) error
+	Stats(ctx context.Context, key string) (ClickStats, error)
 	PingDB(ctx context.Context) error
+	Readiness(ctx context.Context) map[string]error
 	ShortenBatch(ctx context.Context, req BatchRequest) (BatchResponse, error)
+	FlaggedLinks(ctx context.Context) ([]FlaggedLink, error)
+	Preview(ctx context.Context, key string) (LinkPreview, error)
+	ShortURL(ctx context.Context, key string) (string, error)
 }
 
+var (
+	ErrInvalidRequest = errors.New("invalid request")
+	ErrGone           = errors.New("link is no longer available")
+	ErrBlocked        = errors.New("destination is blocked by the domain policy")
+	ErrMalicious      = errors.New("destination is on the threat list")
+
+	ErrWrongPassword   = errors.New("wrong password")
+	ErrTooManyAttempts = errors.New("too many attempts")
+)
+
 type shortURLService struct {
 	keyGenerator keyGenerator
 	storage      storage
 	baseURL      string
+	log          logger
+	attempts     *passwordAttempts
+	clicks       clickRecorder
+	visitors     *visitorCounter
+	ipHashSalt   string
+	urls         urlPolicy
+	policy       *domainPolicy
+	threats      *threatList
+}
+
+// LinkOptions are the optional properties of a short link set at its creation.
+type LinkOptions struct {
+	// absolute moment when the link expires
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// lifetime of the link in seconds, mutually exclusive with ExpiresAt
+	TTL int64 `json:"ttl,omitempty"`
+	// number of redirects after which the link stops resolving
+	MaxClicks int64 `json:"max_clicks,omitempty"`
+	// password to be entered before following the link
+	Password string `json:"password,omitempty"`
+	// HTTP status of the redirect: 301, 302, 307 or 308
+	RedirectType int `json:"redirect_type,omitempty"`
+	// whether the trailing path and query of the short URL are passed to the original URL
+	Passthrough bool `json:"passthrough,omitempty"`
 }
 
 func newService(cfg config) (s service, err error) {
@@ -28,21 +76,111 @@ func newService(cfg config) (s service, err error) {
 	if err != nil {
 		return
 	}
+	if cfg.bloomFPRate > 0 {
+		st, err = newBloomStorage(context.Background(), st, cfg)
+		if err != nil {
+			return
+		}
+	}
+	if cfg.cacheSize > 0 {
+		st = newCachedStorage(st, cfg)
+	}
+	st = tracedStorage{st, cfg.tracer.Tracer(tracerName)}
 	kg := newBase62Generator(uuid + 1)
-	s = shortURLService{kg, st, cfg.baseURL}
+	registerGauge(cfg.metrics, "keygen_position", "The last generated key uuid.", nil,
+		func() float64 { return float64(kg.position()) })
+	policy, err := newDomainPolicy(cfg.background, cfg.domainPolicyPath, cfg.log)
+	if err != nil {
+		return
+	}
+	threats, err := newThreatList(cfg.background, cfg.threatListPath, cfg.log)
+	if err != nil {
+		return
+	}
+	salt := cfg.ipHashSalt
+	if salt == "" {
+		salt, err = st.IPHashSalt(context.Background(), rand.Text())
+		if err != nil {
+			err = fmt.Errorf("failed to get ip hash salt: %w", err)
+			return
+		}
+	}
+	vc := newVisitorCounter(cfg.background, st, cfg.log)
+	svc := shortURLService{kg, st, cfg.baseURL, cfg.log,
+		newPasswordAttempts(), newClickRecorder(st, vc, cfg.log), vc, salt, cfg.urlPolicy, policy, threats}
+	if cfg.sweepInterval > 0 {
+		go every(cfg.background, cfg.sweepInterval, svc.sweepExpired)
+	}
+	s = tracedService{svc, cfg.tracer.Tracer(tracerName)}
 
 	return
 }
 
-func (s shortURLService) CreateShortURL(ctx context.Context, url string) (shortURL string, err error) {
-	key := s.keyGenerator.Generate(url)
+func (s shortURLService) newLink(rawURL string, opts LinkOptions) (link, error) {
+	url, err := s.urls.normalize(rawURL)
+	if err != nil {
+		return link{}, err
+	}
+	if !s.policy.allows(url) {
+		return link{}, invalidURL(ReasonDomainNotAllowed, "the domain of %s is not allowed", url)
+	}
+	if s.threats.flags(url) {
+		return link{}, invalidURL(ReasonMalicious, "%s is on the threat list", url)
+	}
+
+	l := link{
+		originalURL:  url,
+		maxClicks:    opts.MaxClicks,
+		clicksLeft:   opts.MaxClicks,
+		redirectType: opts.RedirectType,
+		passthrough:  opts.Passthrough,
+		createdAt:    time.Now(),
+	}
 
-	err = s.storage.Store(ctx, key, url)
-	if errors.Is(err, ErrConflict) {
-		key, err = s.storage.LookUpKey(ctx, url)
-		if err == nil {
-			err = ErrConflict
+	if opts.MaxClicks < 0 {
+		return l, fmt.Errorf("negative max_clicks %d: %w", opts.MaxClicks, ErrInvalidRequest)
+	}
+
+	if opts.RedirectType != 0 && !isRedirect(opts.RedirectType) {
+		return l, fmt.Errorf("unsupported redirect_type %d: %w", opts.RedirectType, ErrInvalidRequest)
+	}
+
+	if opts.Password != "" {
+		hash, err := hashPassword(opts.Password)
+		if err != nil {
+			return l, fmt.Errorf("unusable password: %v: %w", err, ErrInvalidRequest)
 		}
+		l.passwordHash = hash
+	}
+
+	switch {
+	case opts.TTL < 0:
+		return l, fmt.Errorf("negative ttl %d: %w", opts.TTL, ErrInvalidRequest)
+	case opts.TTL > 0 && !opts.ExpiresAt.IsZero():
+		return l, fmt.Errorf("ttl and expires_at are mutually exclusive: %w", ErrInvalidRequest)
+	case opts.TTL > 0:
+		l.expiresAt = time.Now().Add(time.Duration(opts.TTL) * time.Second)
+	case !opts.ExpiresAt.IsZero():
+		if l.expiresAt = opts.ExpiresAt; l.expired(time.Now()) {
+			return l, fmt.Errorf("expires_at %v is in the past: %w", opts.ExpiresAt, ErrInvalidRequest)
+		}
+	}
+
+	l.shortKey = s.keyGenerator.Generate(url)
+
+	return l, nil
+}
+
+func (s shortURLService) CreateShortURL(ctx context.Context, url string, opts LinkOptions) (shortURL string, err error) {
+	l, err := s.newLink(url, opts)
+	if err != nil {
+		return "", err
+	}
+	key := l.shortKey
+
+	err = s.storage.Store(ctx, l)
+	if errors.Is(err, ErrConflict) {
+		key, err = s.duplicate(ctx, l, opts.Password, true)
 	} else if err != nil {
 		err = fmt.Errorf("failed to store key %v: [%w]", key, err)
 	}
@@ -50,21 +188,185 @@ func (s shortURLService) CreateShortURL(ctx context.Context, url string) (shortU
 	return shortURL, err
 }
 
-func (s shortURLService) LookUp(ctx context.Context, key string) (url string, err error) {
-	url, err = s.storage.LookUp(ctx, key)
+// duplicate is the key of the link already stored for the original URL. It is only handed back
+// when the link has the requested options, so that nobody takes an unprotected link for a protected one.
+// An expired or exhausted link would only answer 410, so it is replaced with the new one if replaceStale.
+func (s shortURLService) duplicate(ctx context.Context, l link, password string, replaceStale bool) (shortKey, error) {
+	key, err := s.storage.LookUpKey(ctx, l.originalURL)
+	if err != nil {
+		return key, err
+	}
+	stored, err := s.storage.Peek(ctx, key.shortURL)
+	if err != nil {
+		return key, err
+	}
+
+	if replaceStale && (stored.expired(time.Now()) || stored.exhausted()) {
+		if err = s.storage.Delete(ctx, key.shortURL); err != nil {
+			return shortKey{}, fmt.Errorf("failed to delete stale key %v: [%w]", key.shortURL, err)
+		}
+		// another conflict means a concurrent request got ahead, so its link is the duplicate
+		if err = s.storage.Store(ctx, l); errors.Is(err, ErrConflict) {
+			return s.duplicate(ctx, l, password, false)
+		} else if err != nil {
+			return shortKey{}, fmt.Errorf("failed to replace stale key %v: [%w]", key.shortURL, err)
+		}
+		return l.shortKey, nil
+	}
+
+	if !sameOptions(stored, l, password) {
+		return shortKey{}, fmt.Errorf("url %s is already shortened with other options: %w",
+			l.originalURL, ErrInvalidRequest)
+	}
+	return key, ErrConflict
+}
+
+// sameOptions compares the stored link with the one to be created for the same URL.
+// The expiration is compared to the second, as precise as the requests get it.
+func sameOptions(stored, l link, password string) bool {
+	if stored.maxClicks != l.maxClicks || stored.redirectType != l.redirectType ||
+		stored.passthrough != l.passthrough || stored.protected() != l.protected() ||
+		!stored.expiresAt.Truncate(time.Second).Equal(l.expiresAt.Truncate(time.Second)) {
+		return false
+	}
+	return !l.protected() || checkPassword(stored.passwordHash, password)
+}
+
+// LookUp checks whether the link can be followed without consuming its clicks,
+// see ConsumeClick.
+func (s shortURLService) LookUp(ctx context.Context, key string) (link, error) {
+	l, err := s.peekValid(ctx, key)
+	if err != nil {
+		return l, err
+	}
+	// the policy may have changed since the link was created
+	if !s.policy.allows(l.originalURL) {
+		return l, fmt.Errorf("key %v: %w", key, ErrBlocked)
+	}
+	// the link is flagged rather than refused, so that the user can be warned
+	if s.threats.flags(l.originalURL) {
+		return l, fmt.Errorf("key %v: %w", key, ErrMalicious)
+	}
+	return l, nil
+}
+
+// peekValid is the link of the key unless it is gone because of its clicks or expiration.
+func (s shortURLService) peekValid(ctx context.Context, key string) (link, error) {
+	l, err := s.storage.Peek(ctx, key)
+	if err != nil {
+		return l, fmt.Errorf("key %v not found: [%w]", key, err)
+	}
+	if l.exhausted() {
+		return l, errExhausted(l)
+	}
+	if l.expired(time.Now()) {
+		return l, fmt.Errorf("key %v expired at %v: %w", key, l.expiresAt, ErrGone)
+	}
+	return l, nil
+}
+
+// Unlock verifies the password of a protected link. Its click is consumed
+// by ConsumeClick like the click of any other link.
+func (s shortURLService) Unlock(ctx context.Context, key, password string) (link, error) {
+	if err := s.attempts.reserve(key, time.Now()); err != nil {
+		return link{}, err
+	}
+
+	// the destination of a flagged link is only shown to those knowing the password
+	l, err := s.LookUp(ctx, key)
+	flagged := errors.Is(err, ErrMalicious)
+	if err != nil && !flagged {
+		return l, err
+	} else if !l.protected() {
+		s.attempts.reset(key) // there is no password to guess
+		return l, err
+	}
+
+	if !checkPassword(l.passwordHash, password) {
+		return l, fmt.Errorf("key %v: %w", key, ErrWrongPassword) // the attempt stays counted
+	}
+	s.attempts.reset(key)
+
+	if flagged {
+		return l, fmt.Errorf("key %v: %w", key, ErrMalicious)
+	}
+	return l, nil
+}
+
+// ConsumeClick takes a click of a click-limited link right before the redirect,
+// so that the requests refused for any other reason don't use the clicks up.
+func (s shortURLService) ConsumeClick(ctx context.Context, l link) (link, error) {
+	if !l.clickLimited() {
+		return l, nil
+	}
+	return s.storage.ConsumeClick(ctx, l)
+}
+
+// RecordClick keeps the hash of the client IP rather than the IP itself.
+func (s shortURLService) RecordClick(c click) {
+	c.ipHash, c.ip = hashIP(c.ip, s.ipHashSalt), ""
+	s.clicks.record(c)
+}
+
+// Flush stores the clicks first, as they add to the visitors.
+func (s shortURLService) Flush(ctx context.Context) error {
+	if err := s.clicks.flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush clicks: %w", err)
+	}
+	if err := s.visitors.flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush visitors: %w", err)
+	}
+	return s.storage.Flush(ctx)
+}
+
+func (s shortURLService) Stats(ctx context.Context, key string) (ClickStats, error) {
+	stats := ClickStats{Key: key}
+
+	if _, err := s.storage.Peek(ctx, key); err != nil {
+		return stats, fmt.Errorf("key %v not found: [%w]", key, err)
+	}
+
+	daily, err := s.storage.ClickStats(ctx, key)
+	if err != nil {
+		return stats, fmt.Errorf("failed to get click stats of key %v: [%w]", key, err)
+	}
+
+	visitors, total, err := s.visitors.visitors(ctx, key)
 	if err != nil {
-		return "", fmt.Errorf("key %v not found: [%w]", key, err)
+		return stats, fmt.Errorf("failed to estimate visitors of key %v: [%w]", key, err)
+	}
+
+	stats.Daily = daily
+	stats.Visitors = total
+	for i, d := range daily {
+		stats.Total += d.Clicks
+		stats.Daily[i].Visitors = visitors[d.Date]
+	}
+	return stats, nil
+}
+
+// sweepExpired removes the expired links from the storage.
+func (s shortURLService) sweepExpired(ctx context.Context, now time.Time) {
+	purged, err := s.storage.PurgeExpired(ctx, now)
+	if err != nil {
+		s.log.Error(err, "purging expired links")
+	} else if len(purged) > 0 {
+		s.log.Info("purged %d expired links", len(purged))
 	}
-	return url, nil
 }
 
 func (s shortURLService) PingDB(ctx context.Context) error {
 	return s.storage.Ping(ctx)
 }
 
+func (s shortURLService) Readiness(ctx context.Context) map[string]error {
+	return s.storage.Readiness(ctx)
+}
+
 type BatchRequest []struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	LinkOptions
 }
 
 type BatchResponse []struct {
@@ -77,12 +379,14 @@ func (s shortURLService) ShortenBatch(ctx context.Context, req BatchRequest) (Ba
 	data := make(urlBatch, len(req))
 
 	for i, r := range req {
-		key := s.keyGenerator.Generate(r.OriginalURL)
-		data[i].shortKey = key
-		data[i].originalURL = r.OriginalURL
+		l, err := s.newLink(r.OriginalURL, r.LinkOptions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch item %s: %w", r.CorrelationID, err)
+		}
+		data[i] = l
 
 		resp[i].CorrelationID = r.CorrelationID
-		resp[i].ShortURL = s.baseURL + "/" + key.shortURL
+		resp[i].ShortURL = s.baseURL + "/" + l.shortURL
 	}
 
 	if err := s.storage.StoreBatch(ctx, data); err != nil {
@@ -91,3 +395,74 @@ func (s shortURLService) ShortenBatch(ctx context.Context, req BatchRequest) (Ba
 
 	return resp, nil
 }
+
+type FlaggedLink struct {
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+}
+
+// FlaggedLinks scans all the links for the ones on the threat list.
+func (s shortURLService) FlaggedLinks(ctx context.Context) ([]FlaggedLink, error) {
+	flagged := []FlaggedLink{}
+
+	err := s.storage.EachLink(ctx, func(l link) {
+		if s.threats.flags(l.originalURL) {
+			flagged = append(flagged, FlaggedLink{s.baseURL + "/" + l.shortURL, l.originalURL})
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan links: [%w]", err)
+	}
+
+	slices.SortFunc(flagged, func(a, b FlaggedLink) int { return strings.Compare(a.ShortURL, b.ShortURL) })
+	return flagged, nil
+}
+
+// ShortURL is the full short URL of an existing link, e.g. to encode it in a QR code.
+func (s shortURLService) ShortURL(ctx context.Context, key string) (string, error) {
+	if _, err := s.peekValid(ctx, key); err != nil {
+		return "", err
+	}
+	return s.baseURL + "/" + key, nil
+}
+
+// LinkPreview tells where a link goes without following it.
+type LinkPreview struct {
+	ShortURL    string
+	OriginalURL string // empty for the password protected links
+	CreatedAt   time.Time
+	Clicks      int64
+	Protected   bool
+	Flagged     bool
+}
+
+// Preview peeks at the link, so that neither its clicks are consumed nor recorded.
+// The destination of a protected link stays hidden until the password is given.
+func (s shortURLService) Preview(ctx context.Context, key string) (LinkPreview, error) {
+	l, err := s.peekValid(ctx, key)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	if !s.policy.allows(l.originalURL) {
+		return LinkPreview{}, fmt.Errorf("key %v: %w", key, ErrBlocked)
+	}
+
+	daily, err := s.storage.ClickStats(ctx, key)
+	if err != nil {
+		return LinkPreview{}, fmt.Errorf("failed to get click stats of key %v: [%w]", key, err)
+	}
+
+	p := LinkPreview{
+		ShortURL:  s.baseURL + "/" + key,
+		CreatedAt: l.createdAt,
+		Protected: l.protected(),
+		Flagged:   s.threats.flags(l.originalURL),
+	}
+	if !p.Protected {
+		p.OriginalURL = l.originalURL
+	}
+	for _, d := range daily {
+		p.Clicks += d.Clicks
+	}
+	return p, nil
+}
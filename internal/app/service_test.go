@@ -0,0 +1,199 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// uniqueStorage rejects the original URLs stored before, as the database does.
+type uniqueStorage struct {
+	inMemStorage
+}
+
+func (us uniqueStorage) Store(ctx context.Context, l link) error {
+	if _, err := us.LookUpKey(ctx, l.originalURL); err == nil {
+		return ErrConflict
+	}
+	return us.inMemStorage.Store(ctx, l)
+}
+
+func (us uniqueStorage) LookUpKey(_ context.Context, url string) (shortKey, error) {
+	var (
+		key   shortKey
+		found bool
+	)
+	us.data.Range(func(_ string, l link) bool {
+		if l.originalURL == url {
+			key, found = l.shortKey, true
+		}
+		return !found
+	})
+	if !found {
+		return key, errNotFound
+	}
+	return key, nil
+}
+
+// racingStorage stores a link of a concurrent request right after a stale one is deleted.
+type racingStorage struct {
+	uniqueStorage
+	concurrent link
+}
+
+func (rs racingStorage) Delete(ctx context.Context, shortURL string) error {
+	if err := rs.uniqueStorage.Delete(ctx, shortURL); err != nil {
+		return err
+	}
+	return rs.uniqueStorage.Store(ctx, rs.concurrent)
+}
+
+func newTestService(t *testing.T) shortURLService {
+	return shortURLService{
+		keyGenerator: newBase62Generator(1),
+		storage:      uniqueStorage{newInMemStorage()},
+		baseURL:      DefaultBaseURL,
+		log:          testLogger{t: t},
+		attempts:     newPasswordAttempts(),
+		urls:         urlPolicy{schemes: []string{"http", "https"}, maxLength: 2048},
+	}
+}
+
+func TestConflictWithOtherOptions(t *testing.T) {
+	passwordHashCost = bcrypt.MinCost
+	defer func() { passwordHashCost = bcrypt.DefaultCost }()
+
+	svc := newTestService(t)
+	ctx := context.Background()
+	const url = "https://pkg.go.dev/cmp"
+
+	plain, err := svc.CreateShortURL(ctx, url, LinkOptions{})
+	require.NoError(t, err)
+
+	shortURL, err := svc.CreateShortURL(ctx, url, LinkOptions{})
+	assert.ErrorIs(t, err, ErrConflict, "Duplicate")
+	assert.Equal(t, plain, shortURL, "Duplicate")
+
+	for _, opts := range []LinkOptions{
+		{Password: "secret"},
+		{MaxClicks: 1},
+		{TTL: 60},
+		{RedirectType: 301},
+		{Passthrough: true},
+	} {
+		shortURL, err = svc.CreateShortURL(ctx, url, opts)
+		assert.ErrorIs(t, err, ErrInvalidRequest, "%+v", opts)
+		assert.NotEqual(t, plain, shortURL, "%+v", opts)
+	}
+
+	const protectedURL = "https://pkg.go.dev/crypto"
+	protected, err := svc.CreateShortURL(ctx, protectedURL, LinkOptions{Password: "secret"})
+	require.NoError(t, err)
+
+	shortURL, err = svc.CreateShortURL(ctx, protectedURL, LinkOptions{Password: "secret"})
+	assert.ErrorIs(t, err, ErrConflict, "Same password")
+	assert.Equal(t, protected, shortURL, "Same password")
+
+	_, err = svc.CreateShortURL(ctx, protectedURL, LinkOptions{Password: "other"})
+	assert.ErrorIs(t, err, ErrInvalidRequest, "Other password")
+	_, err = svc.CreateShortURL(ctx, protectedURL, LinkOptions{})
+	assert.ErrorIs(t, err, ErrInvalidRequest, "No password")
+}
+
+func TestConflictWithStaleLink(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+
+	expired := link{shortKey: shortKey{100, "expird"}, originalURL: "https://pkg.go.dev/time",
+		expiresAt: time.Now().Add(-time.Second)}
+	require.NoError(t, svc.storage.Store(ctx, expired))
+
+	shortURL, err := svc.CreateShortURL(ctx, expired.originalURL, LinkOptions{})
+	require.NoError(t, err, "Expired link replaced")
+	assert.NotEqual(t, DefaultBaseURL+"/"+expired.shortURL, shortURL)
+	_, err = svc.storage.Peek(ctx, expired.shortURL)
+	assert.ErrorIs(t, err, errNotFound, "Expired link deleted")
+
+	const url = "https://pkg.go.dev/sync"
+	limited, err := svc.CreateShortURL(ctx, url, LinkOptions{MaxClicks: 1})
+	require.NoError(t, err)
+	l, err := svc.storage.Peek(ctx, strings.TrimPrefix(limited, DefaultBaseURL+"/"))
+	require.NoError(t, err)
+	_, err = svc.storage.ConsumeClick(ctx, l)
+	require.NoError(t, err)
+
+	shortURL, err = svc.CreateShortURL(ctx, url, LinkOptions{MaxClicks: 1})
+	require.NoError(t, err, "Exhausted link replaced")
+	assert.NotEqual(t, limited, shortURL)
+}
+
+func TestConflictWhileReplacingStaleLink(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+
+	const url = "https://pkg.go.dev/time"
+	concurrent := link{shortKey: shortKey{101, "concur"}, originalURL: url}
+	svc.storage = racingStorage{svc.storage.(uniqueStorage), concurrent}
+	expired := link{shortKey: shortKey{100, "expird"}, originalURL: url, expiresAt: time.Now().Add(-time.Second)}
+	require.NoError(t, svc.storage.Store(ctx, expired))
+
+	shortURL, err := svc.CreateShortURL(ctx, url, LinkOptions{})
+	assert.ErrorIs(t, err, ErrConflict, "Link of the concurrent request")
+	assert.Equal(t, DefaultBaseURL+"/"+concurrent.shortURL, shortURL)
+}
+
+func TestPasswordAttemptsPerLink(t *testing.T) {
+	passwordHashCost = bcrypt.MinCost
+	defer func() { passwordHashCost = bcrypt.DefaultCost }()
+
+	svc := newTestService(t)
+	ctx := context.Background()
+	const url = "https://pkg.go.dev/crypto"
+	shortURL, err := svc.CreateShortURL(ctx, url, LinkOptions{Password: "secret"})
+	require.NoError(t, err)
+	key := strings.TrimPrefix(shortURL, DefaultBaseURL+"/")
+
+	const guesses = 4 * maxPasswordFailures
+	var wrong, locked atomic.Int32
+	var wg sync.WaitGroup
+	for range guesses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.Unlock(ctx, key, "wrong")
+			if errors.Is(err, ErrWrongPassword) {
+				wrong.Add(1)
+			} else if errors.Is(err, ErrTooManyAttempts) {
+				locked.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, maxPasswordFailures, wrong.Load(), "Passwords compared")
+	assert.EqualValues(t, guesses-maxPasswordFailures, locked.Load(), "Attempts refused")
+
+	_, err = svc.Unlock(ctx, key, "secret")
+	assert.ErrorIs(t, err, ErrTooManyAttempts, "Locked out link")
+}
+
+func TestPasswordAttemptsExpire(t *testing.T) {
+	pa := newPasswordAttempts()
+	now := time.Now()
+	for range maxPasswordFailures {
+		require.NoError(t, pa.reserve("aaaaab", now))
+	}
+	assert.ErrorIs(t, pa.reserve("aaaaab", now), ErrTooManyAttempts, "Locked out link")
+	require.NoError(t, pa.reserve("aaaaac", now.Add(passwordLockout/2)))
+
+	require.NoError(t, pa.reserve("aaaaab", now.Add(passwordLockout)), "Lockout over")
+	require.NoError(t, pa.reserve("aaaaad", now.Add(2*passwordLockout)))
+	assert.Len(t, pa.failures, 1, "Attempts kept after the lockout")
+}
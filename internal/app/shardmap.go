@@ -0,0 +1,154 @@
+package app
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+const mapShards = 64 // a power of two
+
+// shardedMap is a concurrent map with string keys that spreads the keys over shards
+// guarded by their own locks, so that writers of different keys rarely contend.
+// It keeps track of the approximate memory taken by the entries as measured by sizeOf.
+type shardedMap[V comparable] struct {
+	seed   maphash.Seed
+	shards *[mapShards]mapShard[V]
+	sizeOf func(key string, v V) int64
+	bytes  *atomic.Int64
+	len    *atomic.Int64
+}
+
+type mapShard[V comparable] struct {
+	mu sync.RWMutex
+	m  map[string]V
+}
+
+func newShardedMap[V comparable](sizeOf func(key string, v V) int64) shardedMap[V] {
+	sm := shardedMap[V]{
+		seed:   maphash.MakeSeed(),
+		shards: &[mapShards]mapShard[V]{},
+		sizeOf: sizeOf,
+		bytes:  &atomic.Int64{},
+		len:    &atomic.Int64{},
+	}
+	for i := range sm.shards {
+		sm.shards[i].m = make(map[string]V)
+	}
+	return sm
+}
+
+func (sm shardedMap[V]) shard(key string) *mapShard[V] {
+	return &sm.shards[maphash.String(sm.seed, key)&(mapShards-1)]
+}
+
+func (sm shardedMap[V]) Load(key string) (V, bool) {
+	s := sm.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok := s.m[key]
+	return v, ok
+}
+
+func (sm shardedMap[V]) Store(key string, v V) {
+	s := sm.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sm.replace(s, key, v)
+}
+
+// CompareAndSwap stores the new value only if the current one equals the old value.
+func (sm shardedMap[V]) CompareAndSwap(key string, old, new V) bool {
+	s := sm.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.m[key]; !ok || v != old {
+		return false
+	}
+	sm.replace(s, key, new)
+	return true
+}
+
+// Compute stores the value the function returns for the current one and returns it.
+// The function runs under the lock of the shard, so it must be quick.
+func (sm shardedMap[V]) Compute(key string, fn func(old V, loaded bool) V) V {
+	s := sm.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, loaded := s.m[key]
+	v := fn(old, loaded)
+	sm.replace(s, key, v)
+	return v
+}
+
+func (sm shardedMap[V]) replace(s *mapShard[V], key string, v V) {
+	if old, ok := s.m[key]; ok {
+		sm.bytes.Add(-sm.sizeOf(key, old))
+	} else {
+		sm.len.Add(1)
+	}
+	s.m[key] = v
+	sm.bytes.Add(sm.sizeOf(key, v))
+}
+
+func (sm shardedMap[V]) Delete(key string) {
+	s := sm.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.m[key]; ok {
+		sm.remove(s, key, v)
+	}
+}
+
+func (sm shardedMap[V]) remove(s *mapShard[V], key string, v V) {
+	delete(s.m, key)
+	sm.len.Add(-1)
+	sm.bytes.Add(-sm.sizeOf(key, v))
+}
+
+// DeleteFunc deletes the entries the function returns true for and returns their keys.
+func (sm shardedMap[V]) DeleteFunc(del func(key string, v V) bool) []string {
+	var deleted []string
+	for i := range sm.shards {
+		s := &sm.shards[i]
+		s.mu.Lock()
+		for key, v := range s.m {
+			if del(key, v) {
+				sm.remove(s, key, v)
+				deleted = append(deleted, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return deleted
+}
+
+// Range calls the function for every entry until it returns false.
+// The function must not modify the map.
+func (sm shardedMap[V]) Range(fn func(key string, v V) bool) {
+	for i := range sm.shards {
+		s := &sm.shards[i]
+		s.mu.RLock()
+		for key, v := range s.m {
+			if !fn(key, v) {
+				s.mu.RUnlock()
+				return
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
+
+func (sm shardedMap[V]) Len() int64 {
+	return sm.len.Load()
+}
+
+// Bytes is the approximate memory taken by the entries.
+func (sm shardedMap[V]) Bytes() int64 {
+	return sm.bytes.Load()
+}
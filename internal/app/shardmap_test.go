@@ -0,0 +1,85 @@
+package app
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedMapAccounting(t *testing.T) {
+	sm := newShardedMap(func(key string, v string) int64 { return int64(len(key) + len(v)) })
+
+	sm.Store("a", "1234")
+	sm.Store("b", "12")
+	assert.Equal(t, int64(2), sm.Len())
+	assert.Equal(t, int64(8), sm.Bytes())
+
+	assert.False(t, sm.CompareAndSwap("a", "wrong", "1"), "Swap of a changed value")
+	assert.True(t, sm.CompareAndSwap("a", "1234", "1"))
+	assert.Equal(t, int64(5), sm.Bytes(), "Bytes after the swap")
+
+	v := sm.Compute("b", func(old string, loaded bool) string { return old + "3" })
+	assert.Equal(t, "123", v, "Computed value")
+	assert.Equal(t, int64(6), sm.Bytes(), "Bytes after the compute")
+	sm.Compute("b", func(string, bool) string { return "12" })
+
+	deleted := sm.DeleteFunc(func(key, v string) bool { return v == "12" })
+	assert.Equal(t, []string{"b"}, deleted)
+	sm.Delete("a")
+	sm.Delete("unknown")
+	assert.Equal(t, int64(0), sm.Len())
+	assert.Equal(t, int64(0), sm.Bytes())
+}
+
+func TestShardedMapConcurrentWrites(t *testing.T) {
+	sm := newShardedMap(func(key string, v int) int64 { return 1 })
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 1000 {
+				sm.Store(strconv.Itoa(g*1000+i), i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	n := 0
+	sm.Range(func(string, int) bool {
+		n++
+		return true
+	})
+	assert.Equal(t, 8000, n)
+	assert.Equal(t, int64(8000), sm.Len())
+}
+
+func BenchmarkShardedMapStore(b *testing.B) {
+	sm := newShardedMap(linkSize)
+	var next atomic.Uint64
+
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			i := next.Add(1)
+			key := strconv.FormatUint(i, 36)
+			sm.Store(key, link{shortKey: shortKey{i, key}})
+		}
+	})
+}
+
+func BenchmarkSyncMapStore(b *testing.B) {
+	var sm sync.Map
+	var next atomic.Uint64
+
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			i := next.Add(1)
+			key := strconv.FormatUint(i, 36)
+			sm.Store(key, link{shortKey: shortKey{i, key}})
+		}
+	})
+}
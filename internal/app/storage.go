@@ -11,33 +11,111 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var errNotFound = errors.New("short URL not found")
+
 type storage interface {
-	Store(ctx context.Context, key shortKey, url string) error
-	LookUp(ctx context.Context, shortURL string) (url string, err error)
+	Store(ctx context.Context, l link) error
+	// Peek looks up a link without consuming its clicks.
+	Peek(ctx context.Context, shortURL string) (link, error)
+	// ConsumeClick takes a click of a click-limited link and fails with ErrGone
+	// when there are no clicks left. It is called right before the redirect,
+	// once everything else about the request has been checked.
+	ConsumeClick(ctx context.Context, l link) (link, error)
 	Ping(ctx context.Context) error
+	// Readiness reports the named checks of whether the storage can serve requests.
+	// Nil errors are passed checks.
+	Readiness(ctx context.Context) map[string]error
 	StoreBatch(ctx context.Context, batch urlBatch) error
 	LookUpKey(ctx context.Context, url string) (shortKey, error)
+	EachShortURL(ctx context.Context, fn func(shortURL string)) error
+	EachLink(ctx context.Context, fn func(l link)) error
+	Delete(ctx context.Context, shortURL string) error
+	// PurgeExpired removes the links that expired by the given moment
+	// and returns their short URLs.
+	PurgeExpired(ctx context.Context, now time.Time) ([]string, error)
+	StoreClicks(ctx context.Context, clicks []click) error
+	ClickStats(ctx context.Context, shortURL string) ([]DailyClicks, error)
+	// StoreSketches merges the visitor sketches into the stored ones.
+	StoreSketches(ctx context.Context, sketches []dailySketch) error
+	LoadSketches(ctx context.Context, shortURL string) ([]dailySketch, error)
+	// Flush waits for the writes done in the background, if any.
+	Flush(ctx context.Context) error
+	// IPHashSalt returns the salt stored before, or stores the generated one.
+	IPHashSalt(ctx context.Context, generated string) (string, error)
 }
 
-type urlBatch []struct {
+type link struct {
 	shortKey
-	originalURL string
+	originalURL  string
+	expiresAt    time.Time // zero value means the link never expires
+	maxClicks    int64     // zero value means the number of clicks is unlimited
+	clicksLeft   int64
+	passwordHash string    // empty for links that are not password protected
+	redirectType int       // zero value means the server default status
+	passthrough  bool      // whether the request path and query are passed to the original URL
+	createdAt    time.Time // zero value for the links created before it was recorded
+}
+
+func (l link) expired(now time.Time) bool {
+	return !l.expiresAt.IsZero() && !now.Before(l.expiresAt)
+}
+
+func (l link) clickLimited() bool {
+	return l.maxClicks > 0
+}
+
+func (l link) exhausted() bool {
+	return l.clickLimited() && l.clicksLeft <= 0
+}
+
+func (l link) protected() bool {
+	return l.passwordHash != ""
 }
 
+func errExhausted(l link) error {
+	return fmt.Errorf("short URL %s exhausted its %d clicks: %w", l.shortURL, l.maxClicks, ErrGone)
+}
+
+type urlBatch []link
+
 type inMemStorage struct {
-	data *sync.Map
+	data     shardedMap[link]
+	clicks   *clickCounts
+	visitors *visitorSketches
 }
 
 type fileStorage struct {
 	storage
-	log logger
-	ch  chan urlRec
+	// mu keeps the records of a link in the order of its changes,
+	// e.g. the decremented click counts of the concurrent redirects
+	mu       *sync.Mutex
+	saltPath string
+	log      logger
+	tracer   trace.Tracer
+	ch       chan queuedRec
+	clicks   chan []click
+	visitors chan []dailySketch
+	// flushes are the requests to the writer of every file, see Flush
+	flushes []chan chan struct{}
+}
+
+// queuedRec carries the span and the logger of the request that produced the record
+// so that the write is traced as its child and its errors are logged with the request ID.
+type queuedRec struct {
+	rec  urlRec
+	span trace.SpanContext
+	log  logger
 }
 
 type pgsqlStorage struct {
@@ -45,16 +123,29 @@ type pgsqlStorage struct {
 }
 
 func newStorage(cfg config) (st storage, uuid uint64, err error) {
-	st = newInMemStorage()
+	mem := newInMemStorage()
+	st = mem
 
 	if strings.HasPrefix(cfg.dbDsn, "postgresql") {
 		st, uuid, err = newPgsqlStorage(cfg)
-	} else if cfg.storagePath != "" {
-		uuid, err = readFile(st, cfg.storagePath)
+		return
+	}
+
+	mem.registerMetrics(cfg.metrics)
+	if cfg.storagePath != "" {
+		uuid, err = readFile(mem, cfg.storagePath)
+		if err != nil {
+			return
+		}
+		err = readClicksFile(mem, clicksPath(cfg.storagePath))
+		if err != nil {
+			return
+		}
+		err = readVisitorsFile(mem, visitorsPath(cfg.storagePath))
 		if err != nil {
 			return
 		}
-		st, err = newFileStorage(st, cfg)
+		st, err = newFileStorage(mem, cfg)
 		if err != nil {
 			return
 		}
@@ -64,18 +155,36 @@ func newStorage(cfg config) (st storage, uuid uint64, err error) {
 
 func newInMemStorage() inMemStorage {
 	return inMemStorage{
-		data: &sync.Map{},
+		data:     newShardedMap(linkSize),
+		clicks:   newClickCounts(),
+		visitors: &visitorSketches{sketches: make(sketches)},
 	}
 }
-func (s inMemStorage) Store(ctx context.Context, key shortKey, url string) error {
-	s.data.Store(key.shortURL, url)
+
+// linkSize approximates the memory taken by a link and its map entry.
+func linkSize(key string, l link) int64 {
+	const mapEntryOverhead = 16
+
+	return int64(unsafe.Sizeof(l)) + int64(len(key)+len(l.shortURL)+len(l.originalURL)+len(l.passwordHash)) +
+		mapEntryOverhead
+}
+
+func (s inMemStorage) registerMetrics(reg prometheus.Registerer) {
+	registerGauge(reg, "inmem_storage_links", "Number of links held in memory.", nil,
+		func() float64 { return float64(s.data.Len()) })
+	registerGauge(reg, "inmem_storage_bytes", "Approximate memory taken by the links held in memory.", nil,
+		func() float64 { return float64(s.data.Bytes()) })
+}
+
+func (s inMemStorage) Store(ctx context.Context, l link) error {
+	s.data.Store(l.shortURL, l)
 
 	return nil
 }
 func (s inMemStorage) StoreBatch(ctx context.Context, batch urlBatch) error {
 	var err error
 	for _, b := range batch {
-		err = s.Store(ctx, b.shortKey, b.originalURL)
+		err = s.Store(ctx, b)
 		if err != nil {
 			break
 		}
@@ -83,86 +192,321 @@ func (s inMemStorage) StoreBatch(ctx context.Context, batch urlBatch) error {
 
 	return err
 }
-func (s inMemStorage) LookUp(ctx context.Context, shortURL string) (url string, err error) {
-	v, ok := s.data.Load(shortURL)
+func (s inMemStorage) Peek(ctx context.Context, shortURL string) (link, error) {
+	l, ok := s.data.Load(shortURL)
 	if !ok {
-		return "", errors.New("short URL not found: " + shortURL)
+		return link{}, fmt.Errorf("%w: %s", errNotFound, shortURL)
 	}
-	return v.(string), nil
+	return l, nil
+}
+
+func (s inMemStorage) ConsumeClick(ctx context.Context, l link) (link, error) {
+	for {
+		if l.clicksLeft <= 0 {
+			return l, errExhausted(l)
+		}
+
+		clicked := l
+		clicked.clicksLeft--
+		if s.data.CompareAndSwap(l.shortURL, l, clicked) {
+			return clicked, nil
+		}
+
+		current, ok := s.data.Load(l.shortURL)
+		if !ok {
+			return link{}, fmt.Errorf("%w: %s", errNotFound, l.shortURL)
+		}
+		l = current
+	}
+}
+
+func (s inMemStorage) EachShortURL(ctx context.Context, fn func(shortURL string)) error {
+	s.data.Range(func(k string, _ link) bool {
+		fn(k)
+		return true
+	})
+
+	return nil
+}
+
+func (s inMemStorage) EachLink(ctx context.Context, fn func(l link)) error {
+	s.data.Range(func(_ string, l link) bool {
+		fn(l)
+		return true
+	})
+
+	return nil
+}
+
+func (s inMemStorage) PurgeExpired(ctx context.Context, now time.Time) ([]string, error) {
+	purged := s.data.DeleteFunc(func(_ string, l link) bool {
+		return l.expired(now)
+	})
+
+	return purged, nil
+}
+
+func (s inMemStorage) delete(shortURL string) {
+	s.data.Delete(shortURL)
+}
+
+func (s inMemStorage) Delete(ctx context.Context, shortURL string) error {
+	s.delete(shortURL)
+
+	return nil
 }
 
 func (s inMemStorage) Ping(ctx context.Context) error {
 	return nil
 }
 
+func (s inMemStorage) Flush(ctx context.Context) error {
+	return nil
+}
+
 func (s inMemStorage) LookUpKey(ctx context.Context, url string) (shortKey, error) {
 	return shortKey{}, nil
 }
 
 func newFileStorage(st storage, cfg config) (fileStorage, error) {
 	fs := fileStorage{
-		storage: st,
-		log:     cfg.log,
+		storage:  st,
+		mu:       new(sync.Mutex),
+		saltPath: saltPath(cfg.storagePath),
+		log:      cfg.log,
+		tracer:   cfg.tracer.Tracer(tracerName),
 	}
 
 	f, err := os.OpenFile(cfg.storagePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return fs, fmt.Errorf("failed to open file %s: %w", cfg.storagePath, err)
 	}
-	fs.ch = make(chan urlRec, 100)
-	go fs.storeRec(f)
+	fs.ch = make(chan queuedRec, 100)
+	go fs.storeRec(f, fs.newFlushes())
+
+	path := clicksPath(cfg.storagePath)
+	cf, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fs, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	fs.clicks = make(chan []click, 100)
+	go fs.storeClickRecs(cf, fs.newFlushes())
+
+	path = visitorsPath(cfg.storagePath)
+	vf, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fs, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	fs.visitors = make(chan []dailySketch, 100)
+	go fs.storeSketchRecs(vf, fs.newFlushes())
+
+	fs.registerMetrics(cfg.metrics)
 
 	return fs, nil
 }
 
-func (fs fileStorage) storeRec(file *os.File) {
-	encoder := json.NewEncoder(file)
+func (fs fileStorage) registerMetrics(reg prometheus.Registerer) {
+	const name, help = "file_storage_queue_length", "Number of records waiting to be written to files."
+	registerGauge(reg, name, help, prometheus.Labels{"queue": "urls"},
+		func() float64 { return float64(len(fs.ch)) })
+	registerGauge(reg, name, help, prometheus.Labels{"queue": "clicks"},
+		func() float64 { return float64(len(fs.clicks)) })
+	registerGauge(reg, name, help, prometheus.Labels{"queue": "visitors"},
+		func() float64 { return float64(len(fs.visitors)) })
+}
 
-	for {
-		rec := <-fs.ch
+func (fs *fileStorage) newFlushes() chan chan struct{} {
+	flushes := make(chan chan struct{})
+	fs.flushes = append(fs.flushes, flushes)
+	return flushes
+}
 
-		if err := encoder.Encode(&rec); err != nil {
-			fs.log.Error(err, "writing record %v to file %s", rec, file.Name())
+// writeQueued writes the records as they come, and answers a flush request
+// once the records enqueued before it are written.
+func writeQueued[T any](ch chan T, flushes chan chan struct{}, write func(T)) {
+	for {
+		select {
+		case rec := <-ch:
+			write(rec)
+		case done := <-flushes:
+			for len(ch) > 0 {
+				write(<-ch)
+			}
+			close(done)
 		}
-		if err := file.Sync(); err != nil {
-			fs.log.Error(err, "syncing file %s to disc", file.Name())
+	}
+}
+
+// flushQueued waits for writeQueued to write the records enqueued so far.
+func flushQueued(ctx context.Context, flushes chan chan struct{}) error {
+	done := make(chan struct{})
+	select {
+	case flushes <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush waits for the records enqueued so far to be written to the files.
+func (fs fileStorage) Flush(ctx context.Context) error {
+	for _, flushes := range fs.flushes {
+		if err := flushQueued(ctx, flushes); err != nil {
+			return fmt.Errorf("failed to flush file writes: %w", err)
 		}
 	}
+	return nil
 }
 
-func (fs fileStorage) Store(ctx context.Context, key shortKey, url string) error {
-	if err := fs.storage.Store(ctx, key, url); err != nil {
+func (fs fileStorage) storeRec(file *os.File, flushes chan chan struct{}) {
+	encoder := json.NewEncoder(file)
+
+	writeQueued(fs.ch, flushes, func(q queuedRec) {
+		ctx := trace.ContextWithSpanContext(context.Background(), q.span)
+		_, span := fs.tracer.Start(ctx, "fileStorage.write",
+			trace.WithAttributes(attribute.String("key", q.rec.ShortURL)))
+
+		err := encoder.Encode(&q.rec)
+		if err != nil {
+			q.log.Error(err, "writing record %v to file %s", q.rec, file.Name())
+		} else if err = file.Sync(); err != nil {
+			q.log.Error(err, "syncing file %s to disc", file.Name())
+		}
+		endSpan(span, err)
+	})
+}
+
+func (fs fileStorage) enqueue(ctx context.Context, rec urlRec) {
+	fs.ch <- queuedRec{rec, trace.SpanContextFromContext(ctx), ctxLogger(ctx, fs.log)}
+}
+
+func (fs fileStorage) Store(ctx context.Context, l link) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.storage.Store(ctx, l); err != nil {
 		return err
 	}
 
-	fs.ch <- urlRec{key.uuid, key.shortURL, url}
+	fs.enqueue(ctx, newURLRec(l))
 
 	return nil
 }
 
 func (fs fileStorage) StoreBatch(ctx context.Context, batch urlBatch) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
 	if err := fs.storage.StoreBatch(ctx, batch); err != nil {
 		return err
 	}
 
 	for _, b := range batch {
-		fs.ch <- urlRec{b.uuid, b.shortURL, b.originalURL}
+		fs.enqueue(ctx, newURLRec(b))
 	}
 
 	return nil
 }
 
+// ConsumeClick appends the decremented click count so that it survives restarts.
+func (fs fileStorage) ConsumeClick(ctx context.Context, l link) (link, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	l, err := fs.storage.ConsumeClick(ctx, l)
+	if err == nil {
+		fs.enqueue(ctx, newURLRec(l))
+	}
+
+	return l, err
+}
+
+// Delete appends a tombstone record like PurgeExpired.
+func (fs fileStorage) Delete(ctx context.Context, shortURL string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.storage.Delete(ctx, shortURL); err != nil {
+		return err
+	}
+
+	fs.enqueue(ctx, urlRec{ShortURL: shortURL, Deleted: true})
+
+	return nil
+}
+
+// PurgeExpired appends a tombstone record for every purged link
+// so that it is not restored when the file is read back.
+func (fs fileStorage) PurgeExpired(ctx context.Context, now time.Time) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	purged, err := fs.storage.PurgeExpired(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, shortURL := range purged {
+		fs.enqueue(ctx, urlRec{ShortURL: shortURL, Deleted: true})
+	}
+
+	return purged, nil
+}
+
 func (fs fileStorage) LookUpKey(ctx context.Context, url string) (shortKey, error) {
 	return shortKey{}, nil
 }
 
 type urlRec struct {
-	UUID        uint64 `json:"uuid,string"`
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	UUID         uint64    `json:"uuid,string"`
+	ShortURL     string    `json:"short_url"`
+	OriginalURL  string    `json:"original_url"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+	MaxClicks    int64     `json:"max_clicks,omitempty"`
+	ClicksLeft   int64     `json:"clicks_left,omitempty"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	RedirectType int       `json:"redirect_type,omitempty"`
+	Passthrough  bool      `json:"passthrough,omitempty"`
+	CreatedAt    time.Time `json:"created_at,omitzero"`
+	Deleted      bool      `json:"deleted,omitempty"`
+}
+
+func newURLRec(l link) urlRec {
+	return urlRec{
+		UUID:         l.uuid,
+		ShortURL:     l.shortURL,
+		OriginalURL:  l.originalURL,
+		ExpiresAt:    l.expiresAt,
+		MaxClicks:    l.maxClicks,
+		ClicksLeft:   l.clicksLeft,
+		PasswordHash: l.passwordHash,
+		RedirectType: l.redirectType,
+		Passthrough:  l.passthrough,
+		CreatedAt:    l.createdAt,
+	}
 }
 
-func readFile(st storage, path string) (uuid uint64, err error) {
+func (rec urlRec) link() link {
+	return link{
+		shortKey:     shortKey{rec.UUID, rec.ShortURL},
+		originalURL:  rec.OriginalURL,
+		expiresAt:    rec.ExpiresAt,
+		maxClicks:    rec.MaxClicks,
+		clicksLeft:   rec.ClicksLeft,
+		passwordHash: rec.PasswordHash,
+		redirectType: rec.RedirectType,
+		passthrough:  rec.Passthrough,
+		createdAt:    rec.CreatedAt,
+	}
+}
+
+func readFile(st inMemStorage, path string) (uuid uint64, err error) {
 	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0666)
 	if err != nil {
 		err = fmt.Errorf("failed to open file %s: %w", path, err)
@@ -182,7 +526,12 @@ func readFile(st storage, path string) (uuid uint64, err error) {
 			err = fmt.Errorf("failed to decode record at offset %d: %w", decoder.InputOffset(), err)
 			return
 		}
-		err = st.Store(context.TODO(), shortKey{rec.UUID, rec.ShortURL}, rec.OriginalURL)
+		if rec.Deleted {
+			st.delete(rec.ShortURL)
+			continue
+		}
+
+		err = st.Store(context.TODO(), rec.link())
 		if err != nil {
 			return
 		}
@@ -207,6 +556,8 @@ func newPgsqlStorage(cfg config) (pst pgsqlStorage, uuid uint64, err error) {
 		return
 	}
 
+	cfg.metrics.MustRegister(collectors.NewDBStatsCollector(pst.db, metricsNamespace))
+
 	err = pst.createTables(context.Background())
 	if err != nil {
 		return
@@ -217,6 +568,10 @@ func newPgsqlStorage(cfg config) (pst pgsqlStorage, uuid uint64, err error) {
 	return
 }
 
+func (pst pgsqlStorage) Flush(ctx context.Context) error {
+	return nil
+}
+
 func (pst pgsqlStorage) Ping(ctx context.Context) error {
 	ctx, stop := context.WithTimeout(ctx, 5*time.Second)
 	defer stop()
@@ -235,16 +590,33 @@ CREATE TABLE IF NOT EXISTS urls (
 	original_url TEXT NOT NULL UNIQUE
 );`
 
+// New columns and indexes are appended to the end of the list
+// so that the tables created by the older versions get upgraded.
+var schema = []string{
+	createURLTable,
+	"CREATE INDEX IF NOT EXISTS short_url_idx ON urls (short_url)",
+	"ALTER TABLE urls ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ",
+	"CREATE INDEX IF NOT EXISTS expires_at_idx ON urls (expires_at)",
+	"ALTER TABLE urls ADD COLUMN IF NOT EXISTS max_clicks BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE urls ADD COLUMN IF NOT EXISTS clicks_left BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE urls ADD COLUMN IF NOT EXISTS password_hash TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE urls ADD COLUMN IF NOT EXISTS redirect_type SMALLINT NOT NULL DEFAULT 0",
+	"ALTER TABLE urls ADD COLUMN IF NOT EXISTS passthrough BOOLEAN NOT NULL DEFAULT FALSE",
+	createClicksTable,
+	"CREATE INDEX IF NOT EXISTS clicks_short_url_idx ON clicks (short_url, clicked_at)",
+	createSketchesTable,
+	"ALTER TABLE urls ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ",
+	createSecretsTable,
+}
+
 func (pst pgsqlStorage) createTables(ctx context.Context) error {
-	_, err := pst.db.ExecContext(ctx, createURLTable)
-	if err != nil {
-		return err
+	for _, ddl := range schema {
+		if _, err := pst.db.ExecContext(ctx, ddl); err != nil {
+			return err
+		}
 	}
 
-	const indexQry = "CREATE INDEX IF NOT EXISTS short_url_idx ON urls (short_url)"
-	_, err = pst.db.ExecContext(ctx, indexQry)
-
-	return err
+	return nil
 }
 
 func (pst pgsqlStorage) fetchLastID(ctx context.Context) (uint64, error) {
@@ -260,24 +632,53 @@ func (pst pgsqlStorage) fetchLastID(ctx context.Context) (uint64, error) {
 	return uuid, err
 }
 
-func (pst pgsqlStorage) LookUp(ctx context.Context, shortURL string) (string, error) {
-	const query = "SELECT original_url FROM urls WHERE short_url = $1"
-	var originalURL string
-	err := pst.db.QueryRowContext(ctx, query, shortURL).Scan(&originalURL)
+func (pst pgsqlStorage) Peek(ctx context.Context, shortURL string) (link, error) {
+	const query = `
+		SELECT uuid, original_url, expires_at, max_clicks, clicks_left,
+			password_hash, redirect_type, passthrough, created_at
+		FROM urls WHERE short_url = $1
+	`
+	l := link{shortKey: shortKey{shortURL: shortURL}}
+	var expiresAt, createdAt sql.NullTime
+	err := pst.db.QueryRowContext(ctx, query, shortURL).Scan(&l.uuid, &l.originalURL, &expiresAt,
+		&l.maxClicks, &l.clicksLeft, &l.passwordHash, &l.redirectType, &l.passthrough, &createdAt)
 	if errors.Is(err, sql.ErrNoRows) {
-		err = fmt.Errorf("short URL %s not found: %w", shortURL, err)
+		return l, fmt.Errorf("%w: %s", errNotFound, shortURL)
+	} else if err != nil {
+		return l, err
 	}
-	return originalURL, err
-}
+	l.expiresAt = expiresAt.Time
+	l.createdAt = createdAt.Time
 
-var ErrConflict = errors.New("data conflict")
+	return l, nil
+}
 
-func (pst pgsqlStorage) Store(ctx context.Context, key shortKey, url string) error {
+// The condition on clicks_left makes concurrent redirects
+// consume no more clicks than the link allows.
+func (pst pgsqlStorage) ConsumeClick(ctx context.Context, l link) (link, error) {
 	const query = `
-		INSERT INTO urls (uuid, short_url, original_url)
-		VALUES ($1, $2, $3)
+		UPDATE urls SET clicks_left = clicks_left - 1
+		WHERE short_url = $1 AND clicks_left > 0
+		RETURNING clicks_left
 	`
-	_, err := pst.db.ExecContext(ctx, query, key.uuid, key.shortURL, url)
+	err := pst.db.QueryRowContext(ctx, query, l.shortURL).Scan(&l.clicksLeft)
+	if errors.Is(err, sql.ErrNoRows) {
+		l.clicksLeft = 0
+		err = errExhausted(l)
+	}
+	return l, err
+}
+
+var ErrConflict = errors.New("data conflict")
+
+const insertURL = `
+	INSERT INTO urls (uuid, short_url, original_url, expires_at,
+		max_clicks, clicks_left, password_hash, redirect_type, passthrough, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+`
+
+func (pst pgsqlStorage) Store(ctx context.Context, l link) error {
+	_, err := pst.db.ExecContext(ctx, insertURL, insertArgs(l)...)
 	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) && pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) {
 		err = ErrConflict
@@ -287,25 +688,20 @@ func (pst pgsqlStorage) Store(ctx context.Context, key shortKey, url string) err
 }
 
 func (pst pgsqlStorage) StoreBatch(ctx context.Context, batch urlBatch) error {
-	const query = `
-		INSERT INTO urls (uuid, short_url, original_url)
-		VALUES ($1, $2, $3)
-	`
-
 	tx, err := pst.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.PrepareContext(ctx, query)
+	stmt, err := tx.PrepareContext(ctx, insertURL)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
 	for _, b := range batch {
-		_, err = stmt.ExecContext(ctx, b.uuid, b.shortURL, b.originalURL)
+		_, err = stmt.ExecContext(ctx, insertArgs(b)...)
 		if err != nil {
 			break
 		}
@@ -329,3 +725,90 @@ func (pst pgsqlStorage) LookUpKey(ctx context.Context, url string) (shortKey, er
 	}
 	return shortKey{uuid, shortURL}, err
 }
+
+func (pst pgsqlStorage) PurgeExpired(ctx context.Context, now time.Time) ([]string, error) {
+	const query = "DELETE FROM urls WHERE expires_at <= $1 RETURNING short_url"
+	rows, err := pst.db.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to purge expired urls: %w", err)
+	}
+	defer rows.Close()
+
+	var purged []string
+	for rows.Next() {
+		var shortURL string
+		if err = rows.Scan(&shortURL); err != nil {
+			return purged, err
+		}
+		purged = append(purged, shortURL)
+	}
+
+	return purged, rows.Err()
+}
+
+func (pst pgsqlStorage) Delete(ctx context.Context, shortURL string) error {
+	_, err := pst.db.ExecContext(ctx, "DELETE FROM urls WHERE short_url = $1", shortURL)
+	if err != nil {
+		return fmt.Errorf("failed to delete url %s: %w", shortURL, err)
+	}
+	return nil
+}
+
+func (pst pgsqlStorage) EachShortURL(ctx context.Context, fn func(shortURL string)) error {
+	rows, err := pst.db.QueryContext(ctx, "SELECT short_url FROM urls")
+	if err != nil {
+		return fmt.Errorf("failed to query short urls: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var shortURL string
+		if err = rows.Scan(&shortURL); err != nil {
+			return err
+		}
+		fn(shortURL)
+	}
+
+	return rows.Err()
+}
+
+func (pst pgsqlStorage) EachLink(ctx context.Context, fn func(l link)) error {
+	const query = `
+		SELECT uuid, short_url, original_url, expires_at, max_clicks, clicks_left,
+			password_hash, redirect_type, passthrough, created_at
+		FROM urls
+	`
+	rows, err := pst.db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to query links: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			l                    link
+			expiresAt, createdAt sql.NullTime
+		)
+		err = rows.Scan(&l.uuid, &l.shortURL, &l.originalURL, &expiresAt,
+			&l.maxClicks, &l.clicksLeft, &l.passwordHash, &l.redirectType, &l.passthrough, &createdAt)
+		if err != nil {
+			return err
+		}
+		l.expiresAt = expiresAt.Time
+		l.createdAt = createdAt.Time
+		fn(l)
+	}
+
+	return rows.Err()
+}
+
+func insertArgs(l link) []any {
+	return []any{
+		l.uuid, l.shortURL, l.originalURL, nullTime(l.expiresAt),
+		l.maxClicks, l.clicksLeft, l.passwordHash, l.redirectType, l.passthrough, nullTime(l.createdAt),
+	}
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,218 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorageSkipsPurgedLinks(t *testing.T) {
+	cfg, err := newConfig(WithLogger(testLogger{t: t}), WithDatabaseDsn(""),
+		WithStoragePath(filepath.Join(t.TempDir(), "urls.json")))
+	require.NoError(t, err)
+
+	st, _, err := newStorage(cfg)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	now := time.Now()
+	expired := link{shortKey: shortKey{1, "aaaaab"}, originalURL: "https://pkg.go.dev/time",
+		expiresAt: now.Add(-time.Second)}
+	alive := link{shortKey: shortKey{2, "aaaaac"}, originalURL: "https://pkg.go.dev/cmp",
+		expiresAt: now.Add(time.Hour)}
+	require.NoError(t, st.StoreBatch(ctx, urlBatch{expired, alive}))
+
+	purged, err := st.PurgeExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{expired.shortURL}, purged)
+
+	assert.Eventually(t, func() bool {
+		restored := newInMemStorage()
+		_, err := readFile(restored, cfg.storagePath)
+		if err != nil {
+			return false
+		}
+		if _, err = restored.Peek(ctx, alive.shortURL); err != nil {
+			return false // not written yet
+		}
+		_, err = restored.Peek(ctx, expired.shortURL)
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "purged link restored from file")
+}
+
+func TestFileStorageRestoresClicks(t *testing.T) {
+	cfg, err := newConfig(WithLogger(testLogger{t: t}), WithDatabaseDsn(""),
+		WithStoragePath(filepath.Join(t.TempDir(), "urls.json")))
+	require.NoError(t, err)
+
+	st, _, err := newStorage(cfg)
+	require.NoError(t, err)
+
+	yesterday := time.Date(2025, 6, 30, 23, 59, 0, 0, time.UTC)
+	today := yesterday.Add(time.Minute)
+	clicks := []click{
+		{shortURL: "aaaaab", at: yesterday},
+		{shortURL: "aaaaab", at: today},
+		{shortURL: "aaaaab", at: today},
+		{shortURL: "aaaaac", at: today},
+	}
+	require.NoError(t, st.StoreClicks(context.Background(), clicks))
+
+	expected := []DailyClicks{{Date: "2025-06-30", Clicks: 1}, {Date: "2025-07-01", Clicks: 2}}
+	assert.Eventually(t, func() bool {
+		restored := newInMemStorage()
+		err := readClicksFile(restored, clicksPath(cfg.storagePath))
+		if err != nil {
+			return false
+		}
+		daily, _ := restored.ClickStats(context.Background(), "aaaaab")
+		return assert.ObjectsAreEqual(expected, daily)
+	}, time.Second, 10*time.Millisecond, "clicks restored from file")
+}
+
+// sleepyStorage widens the window between consuming a click and writing it down.
+type sleepyStorage struct {
+	inMemStorage
+}
+
+func (ss sleepyStorage) ConsumeClick(ctx context.Context, l link) (link, error) {
+	l, err := ss.inMemStorage.ConsumeClick(ctx, l)
+	time.Sleep(time.Duration(rand.IntN(1000)) * time.Microsecond)
+	return l, err
+}
+
+func TestFileStorageWritesClicksInOrder(t *testing.T) {
+	cfg, err := newConfig(WithLogger(testLogger{t: t}), WithDatabaseDsn(""),
+		WithStoragePath(filepath.Join(t.TempDir(), "urls.json")))
+	require.NoError(t, err)
+
+	st, err := newFileStorage(sleepyStorage{newInMemStorage()}, cfg)
+	require.NoError(t, err)
+
+	const maxClicks = 100
+	ctx := context.Background()
+	l := link{shortKey: shortKey{1, "aaaaab"}, originalURL: "https://pkg.go.dev/sync", maxClicks: maxClicks, clicksLeft: maxClicks}
+	require.NoError(t, st.Store(ctx, l))
+
+	var wg sync.WaitGroup
+	for range maxClicks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := st.ConsumeClick(ctx, l)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile(cfg.storagePath)
+		return err == nil && bytes.Count(b, []byte("\n")) == 1+maxClicks
+	}, time.Second, 10*time.Millisecond, "records written to file")
+
+	restored := newInMemStorage()
+	_, err = readFile(restored, cfg.storagePath)
+	require.NoError(t, err)
+	found, err := restored.Peek(ctx, l.shortURL)
+	require.NoError(t, err)
+	assert.True(t, found.exhausted(), "clicks left %d", found.clicksLeft)
+}
+
+func TestFileStorageKeepsIPHashSalt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	ctx := context.Background()
+
+	cfg, err := newConfig(WithLogger(testLogger{t: t}), WithDatabaseDsn(""), WithStoragePath(path))
+	require.NoError(t, err)
+	st, _, err := newStorage(cfg)
+	require.NoError(t, err)
+	salt, err := st.IPHashSalt(ctx, "generated")
+	require.NoError(t, err)
+	assert.Equal(t, "generated", salt, "Salt of a new storage")
+
+	cfg, err = newConfig(WithLogger(testLogger{t: t}), WithDatabaseDsn(""), WithStoragePath(path))
+	require.NoError(t, err)
+	restarted, _, err := newStorage(cfg)
+	require.NoError(t, err)
+	salt, err = restarted.IPHashSalt(ctx, "regenerated")
+	require.NoError(t, err)
+	assert.Equal(t, "generated", salt, "Salt after restart")
+}
+
+func TestFileStorageRestoresVisitors(t *testing.T) {
+	cfg, err := newConfig(WithLogger(testLogger{t: t}), WithDatabaseDsn(""),
+		WithStoragePath(filepath.Join(t.TempDir(), "urls.json")))
+	require.NoError(t, err)
+
+	st, _, err := newStorage(cfg)
+	require.NoError(t, err)
+
+	vc := newVisitorCounter(t.Context(), st, cfg.log)
+	at := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	vc.add([]click{
+		{shortURL: "aaaaab", at: at, ipHash: "1", userAgent: "curl"},
+		{shortURL: "aaaaab", at: at, ipHash: "1", userAgent: "curl"},
+		{shortURL: "aaaaab", at: at, ipHash: "1", userAgent: "firefox"},
+		{shortURL: "aaaaab", at: at, ipHash: "2", userAgent: "curl"},
+	})
+	require.NoError(t, vc.flush(context.Background()))
+	vc.add([]click{{shortURL: "aaaaab", at: at, ipHash: "3", userAgent: "curl"}})
+	require.NoError(t, vc.flush(context.Background()))
+
+	assert.Eventually(t, func() bool {
+		restored := newInMemStorage()
+		if err := readVisitorsFile(restored, visitorsPath(cfg.storagePath)); err != nil {
+			return false
+		}
+		daily, total, err := newVisitorCounter(t.Context(), restored, cfg.log).visitors(context.Background(), "aaaaab")
+		return err == nil && total == 4 && daily["2025-07-01"] == 4
+	}, time.Second, 10*time.Millisecond, "visitors restored from file")
+}
+
+type testLogger struct {
+	t      *testing.T
+	fields []any
+}
+
+func (tl testLogger) Debug(msg string, v ...any) {
+	tl.Info(msg, v...)
+}
+
+func (tl testLogger) Info(msg string, v ...any) {
+	tl.t.Log(append([]any{fmt.Sprintf(msg, v...)}, tl.fields...)...)
+}
+
+func (tl testLogger) Warn(msg string, v ...any) {
+	tl.Info(msg, v...)
+}
+
+func (tl testLogger) Error(err error, msg string, v ...any) {
+	tl.Info(msg+": error "+err.Error(), v...)
+}
+
+func (tl testLogger) With(kv ...any) logger {
+	return testLogger{tl.t, append(slices.Clip(tl.fields), kv...)}
+}
+
+func TestSchemaColumns(t *testing.T) {
+	columns := schemaColumns(schema)
+
+	for _, c := range []tableColumn{
+		{"urls", "uuid"}, {"urls", "created_at"}, {"clicks", "ip_hash"},
+		{"visitor_sketches", "sketch"}, {"secrets", "value"},
+	} {
+		assert.Contains(t, columns, c)
+	}
+	assert.NotContains(t, columns, tableColumn{"visitor_sketches", "PRIMARY"}, "Constraint")
+	assert.Len(t, columns, 20, "Columns of the schema")
+}
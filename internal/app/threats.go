@@ -0,0 +1,275 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// threatList flags the URLs found in a local copy of a threat list.
+// Every line of the file is either a hex encoded prefix of the SHA-256 hash
+// of a URL expression marked with sha256:, as in the Safe Browsing lists, or a plain host or URL:
+//
+//	# comment
+//	sha256:1b2a4c8e          hash prefix of 4 to 32 bytes
+//	evil.example             the host and all of its subdomains
+//	example.com/phishing/    all the paths starting with /phishing/
+//	example.com/login.html   exactly this path
+//
+// A prefix match can't be confirmed offline, so the shorter prefixes flag some innocent URLs, too.
+// The file is reloaded when it changes.
+type threatList struct {
+	path    string
+	entries *atomic.Pointer[threatEntries]
+	log     logger
+}
+
+type threatEntries struct {
+	prefixes    map[int]map[string]bool // by the length in bytes
+	expressions map[string]bool
+	modTime     time.Time
+	size        int64
+}
+
+const threatListReloadInterval = time.Minute
+
+// The file is watched until the context is done.
+func newThreatList(ctx context.Context, path string, log logger) (*threatList, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	tl := &threatList{path, &atomic.Pointer[threatEntries]{}, log}
+	entries, err := loadThreatList(path)
+	if err != nil {
+		return nil, err
+	}
+	tl.entries.Store(entries)
+
+	go every(ctx, threatListReloadInterval, tl.watch)
+
+	return tl, nil
+}
+
+// flags is false for any URL without a threat list.
+func (tl *threatList) flags(originalURL string) bool {
+	if tl == nil {
+		return false
+	}
+
+	entries := tl.entries.Load()
+	for _, expr := range urlExpressions(originalURL) {
+		if entries.expressions[expr] {
+			return true
+		}
+
+		hash := sha256.Sum256([]byte(expr))
+		for n, prefixes := range entries.prefixes {
+			if prefixes[string(hash[:n])] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watch reloads the list when the file changes.
+// A broken file is reported and the last good list stays in effect.
+func (tl *threatList) watch(context.Context, time.Time) {
+	reloaded, err := tl.reload()
+	if err != nil {
+		tl.log.Error(err, "reloading threat list")
+	} else if reloaded {
+		tl.log.Info("reloaded threat list from %s", tl.path)
+	}
+}
+
+// reload reads the file again if its modification time or size has changed.
+func (tl *threatList) reload() (bool, error) {
+	fi, err := os.Stat(tl.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat threat list: %w", err)
+	}
+
+	current := tl.entries.Load()
+	if fi.ModTime().Equal(current.modTime) && fi.Size() == current.size {
+		return false, nil
+	}
+
+	entries, err := loadThreatList(tl.path)
+	if err != nil {
+		return false, err
+	}
+	tl.entries.Store(entries)
+	return true, nil
+}
+
+func loadThreatList(path string) (*threatEntries, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open threat list: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat threat list: %w", err)
+	}
+
+	entries := &threatEntries{
+		prefixes:    make(map[int]map[string]bool),
+		expressions: make(map[string]bool),
+		modTime:     fi.ModTime(),
+		size:        fi.Size(),
+	}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if hash, ok := strings.CutPrefix(line, "sha256:"); ok {
+			prefix, err := hashPrefix(hash)
+			if err != nil {
+				return nil, fmt.Errorf("threat list line %d: %w", n, err)
+			}
+			if entries.prefixes[len(prefix)] == nil {
+				entries.prefixes[len(prefix)] = make(map[string]bool)
+			}
+			entries.prefixes[len(prefix)][prefix] = true
+			continue
+		}
+
+		expr, err := threatExpression(line)
+		if err != nil {
+			return nil, fmt.Errorf("threat list line %d: %w", n, err)
+		}
+		entries.expressions[expr] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read threat list: %w", err)
+	}
+
+	return entries, nil
+}
+
+// hashPrefix decodes 4 to 32 hex encoded bytes of a SHA-256 hash.
+func hashPrefix(s string) (string, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) < 4 || len(b) > sha256.Size {
+		return "", fmt.Errorf("invalid hash prefix %s", s)
+	}
+	return string(b), nil
+}
+
+// threatExpression turns a plain host or URL into the form of urlExpressions.
+func threatExpression(line string) (string, error) {
+	line = strings.TrimPrefix(strings.TrimPrefix(line, "http://"), "https://")
+	host, path, _ := strings.Cut(line, "/")
+
+	host, err := normalizeHost(strings.Trim(host, "[]"))
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(host, "[]") + "/" + path, nil
+}
+
+const (
+	maxHostSuffixes = 4
+	maxPathPrefixes = 4
+)
+
+// urlExpressions are the host suffix and path prefix combinations of the URL
+// checked against the threat list as defined by the Safe Browsing API.
+// The URL is expected to be normalized.
+func urlExpressions(originalURL string) []string {
+	u, err := url.Parse(originalURL)
+	if err != nil {
+		return nil
+	}
+
+	host := u.Hostname()
+	hosts := []string{host}
+	if _, err := netip.ParseAddr(host); err != nil {
+		labels := strings.Split(host, ".")
+		for i := max(1, len(labels)-maxHostSuffixes-1); i < len(labels)-1; i++ {
+			hosts = append(hosts, strings.Join(labels[i:], "."))
+		}
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var paths []string
+	if u.RawQuery != "" {
+		paths = append(paths, path+"?"+u.RawQuery)
+	}
+	paths = append(paths, path)
+	var dirs []string
+	if trimmed := strings.Trim(path, "/"); trimmed != "" {
+		dirs = strings.Split(trimmed, "/")
+		if !strings.HasSuffix(path, "/") {
+			dirs = dirs[:len(dirs)-1] // the file name
+		}
+	}
+	prefix := "/"
+	for i := 0; i < maxPathPrefixes; i++ {
+		if prefix != path {
+			paths = append(paths, prefix)
+		}
+		if i >= len(dirs) {
+			break
+		}
+		prefix += dirs[i] + "/"
+	}
+
+	var exprs []string
+	for _, h := range hosts {
+		for _, p := range paths {
+			exprs = append(exprs, h+p)
+		}
+	}
+	return exprs
+}
+
+var warningPageTmpl = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Warning: suspected malicious site</title>
+</head>
+<body>
+	<h1>This link may be harmful</h1>
+	<p>The destination is on a list of phishing and malware sites:</p>
+	<p><code>{{.}}</code></p>
+	<p>If you trust it anyway, <a href="{{.}}" rel="noopener noreferrer nofollow">continue at your own risk</a>.</p>
+</body>
+</html>
+`))
+
+// warningPage is rendered to a buffer first, so that a failure is answered with 500 like previewPage.
+func warningPage(w http.ResponseWriter, originalURL string) error {
+	var buf bytes.Buffer
+	if err := warningPageTmpl.Execute(&buf, originalURL); err != nil {
+		return fmt.Errorf("failed to render warning: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+	return nil
+}
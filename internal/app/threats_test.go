@@ -0,0 +1,104 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestURLExpressions(t *testing.T) {
+	assert.ElementsMatch(t, []string{
+		"a.b.c/1/2.html?param=1", "a.b.c/1/2.html", "a.b.c/", "a.b.c/1/",
+		"b.c/1/2.html?param=1", "b.c/1/2.html", "b.c/", "b.c/1/",
+	}, urlExpressions("http://a.b.c/1/2.html?param=1"))
+
+	assert.ElementsMatch(t, []string{
+		"a.b.c.d.e.f.g/1.html", "a.b.c.d.e.f.g/",
+		"c.d.e.f.g/1.html", "c.d.e.f.g/",
+		"d.e.f.g/1.html", "d.e.f.g/",
+		"e.f.g/1.html", "e.f.g/",
+		"f.g/1.html", "f.g/",
+	}, urlExpressions("http://a.b.c.d.e.f.g/1.html"))
+
+	assert.ElementsMatch(t, []string{"1.2.3.4/1/", "1.2.3.4/"}, urlExpressions("http://1.2.3.4/1/"))
+
+	assert.ElementsMatch(t, []string{
+		"a.b/1/2/3/4/5/6", "a.b/", "a.b/1/", "a.b/1/2/", "a.b/1/2/3/",
+	}, urlExpressions("http://a.b/1/2/3/4/5/6"))
+}
+
+func TestThreatList(t *testing.T) {
+	phishingHash := sha256.Sum256([]byte("phishing.example/"))
+	malwareHash := sha256.Sum256([]byte("example.com/downloads/"))
+
+	path := filepath.Join(t.TempDir(), "threats")
+	require.NoError(t, os.WriteFile(path, []byte(`
+# hash prefixes
+sha256:`+hex.EncodeToString(phishingHash[:4])+`
+sha256:`+hex.EncodeToString(malwareHash[:])+`
+# plain entries
+evil.example
+deadbeef.example
+cafebabe
+https://Example.ORG/login.html
+[2001:db8::1]/
+`), 0666))
+
+	tl, err := newThreatList(t.Context(), path, testLogger{t: t})
+	require.NoError(t, err)
+
+	tests := []struct {
+		url     string
+		flagged bool
+	}{
+		{"https://phishing.example/", true},
+		{"https://www.phishing.example/any/path?q=1", true},
+		{"https://example.com/downloads/setup.exe", true},
+		{"https://example.com/downloads", false},
+		{"https://example.com/", false},
+		{"https://evil.example/", true},
+		{"https://a.b.evil.example/x", true},
+		{"https://notevil.example/", false},
+		{"https://example.org/login.html", true},
+		{"https://example.org/login.html?user=1", true},
+		{"https://example.org/login", false},
+		{"http://[2001:db8::1]/x", true},
+		{"https://deadbeef.example/", true},
+		{"http://cafebabe/", true},
+		{"https://pkg.go.dev/cmp", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.flagged, tl.flags(tt.url), tt.url)
+	}
+
+	var none *threatList
+	assert.False(t, none.flags("https://evil.example/"), "Without a threat list")
+}
+
+func TestThreatListReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "threats")
+	require.NoError(t, os.WriteFile(path, []byte("evil.example\n"), 0666))
+	tl, err := newThreatList(t.Context(), path, testLogger{t: t})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("pkg.go.dev\nexample.com\n"), 0666))
+	reloaded, err := tl.reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded, "Reload of the changed file")
+	assert.False(t, tl.flags("https://evil.example/"))
+	assert.True(t, tl.flags("https://pkg.go.dev/cmp"))
+
+	require.NoError(t, os.WriteFile(path, []byte("exa_mple.com\n"), 0666))
+	_, err = tl.reload()
+	assert.ErrorContains(t, err, "line 1")
+	assert.True(t, tl.flags("https://pkg.go.dev/cmp"), "Last good list")
+
+	require.NoError(t, os.WriteFile(path, []byte("sha256:cafe\n"), 0666))
+	_, err = tl.reload()
+	assert.ErrorContains(t, err, "invalid hash prefix")
+}
@@ -0,0 +1,301 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/hrashk/shorturl/internal/app"
+
+// The OTLP exporter is configured with the standard OTEL_EXPORTER_OTLP_* environment variables,
+// e.g. OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318 for a local collector.
+func newTracerProvider(exporter string) (*sdktrace.TracerProvider, error) {
+	var opt sdktrace.TracerProviderOption
+
+	switch exporter {
+	case "stdout":
+		exp, err := stdouttrace.New()
+		if err != nil {
+			return nil, err
+		}
+		opt = sdktrace.WithSyncer(exp)
+	case "otlp":
+		exp, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		opt = sdktrace.WithBatcher(exp)
+	default:
+		return nil, fmt.Errorf("unknown exporter %s", exporter)
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", "shorturl"))
+	return sdktrace.NewTracerProvider(opt, sdktrace.WithResource(res)), nil
+}
+
+// tracingMiddleware continues the trace of the W3C traceparent header if there is one.
+func tracingMiddleware(tracer trace.Tracer) func(h http.Handler) http.Handler {
+	propagator := propagation.TraceContext{}
+
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("url.path", r.URL.Path),
+				))
+			defer span.End()
+
+			rw := loggingResponseWriter{
+				ResponseWriter: w,
+				status:         http.StatusOK,
+			}
+			h.ServeHTTP(&rw, r.WithContext(ctx))
+
+			route := routePattern(r)
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(
+				attribute.String("http.route", route),
+				attribute.Int("http.response.status_code", rw.status),
+			)
+			if rw.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rw.status))
+			}
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type tracedService struct {
+	service
+	tracer trace.Tracer
+}
+
+func (ts tracedService) CreateShortURL(ctx context.Context, url string, opts LinkOptions) (shortURL string, err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.CreateShortURL")
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.CreateShortURL(ctx, url, opts)
+}
+
+func (ts tracedService) LookUp(ctx context.Context, key string) (l link, err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.LookUp", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.LookUp(ctx, key)
+}
+
+func (ts tracedService) Unlock(ctx context.Context, key, password string) (l link, err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.Unlock", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.Unlock(ctx, key, password)
+}
+
+func (ts tracedService) ConsumeClick(ctx context.Context, l link) (clicked link, err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.ConsumeClick", trace.WithAttributes(attribute.String("key", l.shortURL)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.ConsumeClick(ctx, l)
+}
+
+func (ts tracedService) Flush(ctx context.Context) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.Flush")
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.Flush(ctx)
+}
+
+func (ts tracedService) Stats(ctx context.Context, key string) (stats ClickStats, err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.Stats", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.Stats(ctx, key)
+}
+
+func (ts tracedService) PingDB(ctx context.Context) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.PingDB")
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.PingDB(ctx)
+}
+
+func (ts tracedService) Readiness(ctx context.Context) map[string]error {
+	ctx, span := ts.tracer.Start(ctx, "service.Readiness")
+	defer span.End()
+
+	return ts.service.Readiness(ctx)
+}
+
+func (ts tracedService) ShortenBatch(ctx context.Context, req BatchRequest) (resp BatchResponse, err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.ShortenBatch", trace.WithAttributes(attribute.Int("size", len(req))))
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.ShortenBatch(ctx, req)
+}
+
+func (ts tracedService) FlaggedLinks(ctx context.Context) (flagged []FlaggedLink, err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.FlaggedLinks")
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.FlaggedLinks(ctx)
+}
+
+func (ts tracedService) Preview(ctx context.Context, key string) (p LinkPreview, err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.Preview", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.Preview(ctx, key)
+}
+
+func (ts tracedService) ShortURL(ctx context.Context, key string) (shortURL string, err error) {
+	ctx, span := ts.tracer.Start(ctx, "service.ShortURL", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.service.ShortURL(ctx, key)
+}
+
+type tracedStorage struct {
+	storage
+	tracer trace.Tracer
+}
+
+func (ts tracedStorage) Store(ctx context.Context, l link) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.Store", trace.WithAttributes(attribute.String("key", l.shortURL)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.Store(ctx, l)
+}
+
+func (ts tracedStorage) ConsumeClick(ctx context.Context, l link) (clicked link, err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.ConsumeClick", trace.WithAttributes(attribute.String("key", l.shortURL)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.ConsumeClick(ctx, l)
+}
+
+func (ts tracedStorage) Peek(ctx context.Context, shortURL string) (l link, err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.Peek", trace.WithAttributes(attribute.String("key", shortURL)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.Peek(ctx, shortURL)
+}
+
+func (ts tracedStorage) Ping(ctx context.Context) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.Ping")
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.Ping(ctx)
+}
+
+func (ts tracedStorage) Readiness(ctx context.Context) map[string]error {
+	ctx, span := ts.tracer.Start(ctx, "storage.Readiness")
+	defer span.End()
+
+	return ts.storage.Readiness(ctx)
+}
+
+func (ts tracedStorage) StoreBatch(ctx context.Context, batch urlBatch) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.StoreBatch", trace.WithAttributes(attribute.Int("size", len(batch))))
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.StoreBatch(ctx, batch)
+}
+
+func (ts tracedStorage) LookUpKey(ctx context.Context, url string) (key shortKey, err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.LookUpKey")
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.LookUpKey(ctx, url)
+}
+
+func (ts tracedStorage) EachShortURL(ctx context.Context, fn func(shortURL string)) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.EachShortURL")
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.EachShortURL(ctx, fn)
+}
+
+func (ts tracedStorage) EachLink(ctx context.Context, fn func(l link)) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.EachLink")
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.EachLink(ctx, fn)
+}
+
+func (ts tracedStorage) Delete(ctx context.Context, shortURL string) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.Delete", trace.WithAttributes(attribute.String("key", shortURL)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.Delete(ctx, shortURL)
+}
+
+func (ts tracedStorage) PurgeExpired(ctx context.Context, now time.Time) (purged []string, err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.PurgeExpired")
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.PurgeExpired(ctx, now)
+}
+
+func (ts tracedStorage) StoreClicks(ctx context.Context, clicks []click) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.StoreClicks", trace.WithAttributes(attribute.Int("size", len(clicks))))
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.StoreClicks(ctx, clicks)
+}
+
+func (ts tracedStorage) ClickStats(ctx context.Context, shortURL string) (daily []DailyClicks, err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.ClickStats", trace.WithAttributes(attribute.String("key", shortURL)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.ClickStats(ctx, shortURL)
+}
+
+func (ts tracedStorage) StoreSketches(ctx context.Context, sketches []dailySketch) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.StoreSketches", trace.WithAttributes(attribute.Int("size", len(sketches))))
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.StoreSketches(ctx, sketches)
+}
+
+func (ts tracedStorage) IPHashSalt(ctx context.Context, generated string) (salt string, err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.IPHashSalt")
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.IPHashSalt(ctx, generated)
+}
+
+func (ts tracedStorage) Flush(ctx context.Context) (err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.Flush")
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.Flush(ctx)
+}
+
+func (ts tracedStorage) LoadSketches(ctx context.Context, shortURL string) (daily []dailySketch, err error) {
+	ctx, span := ts.tracer.Start(ctx, "storage.LoadSketches", trace.WithAttributes(attribute.String("key", shortURL)))
+	defer func() { endSpan(span, err) }()
+
+	return ts.storage.LoadSketches(ctx, shortURL)
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/axiomhq/hyperloglog"
+)
+
+// dailySketch estimates the unique visitors of a short URL during a day.
+type dailySketch struct {
+	shortURL string
+	date     string
+	sketch   *hyperloglog.Sketch
+}
+
+// sketches is a set of visitor sketches per short URL and day
+// that are merged with each other on the same short URL and day.
+type sketches map[string]map[string]*hyperloglog.Sketch
+
+func (ss sketches) get(shortURL, date string) *hyperloglog.Sketch {
+	days, ok := ss[shortURL]
+	if !ok {
+		days = make(map[string]*hyperloglog.Sketch)
+		ss[shortURL] = days
+	}
+
+	sk, ok := days[date]
+	if !ok {
+		sk = hyperloglog.New()
+		days[date] = sk
+	}
+	return sk
+}
+
+func (ss sketches) merge(ds dailySketch) error {
+	return ss.get(ds.shortURL, ds.date).Merge(ds.sketch)
+}
+
+func (ss sketches) daily(shortURL string) []dailySketch {
+	days := make([]dailySketch, 0, len(ss[shortURL]))
+	for date, sk := range ss[shortURL] {
+		days = append(days, dailySketch{shortURL, date, sk.Clone()})
+	}
+	return days
+}
+
+func (ss sketches) all() []dailySketch {
+	var all []dailySketch
+	for shortURL, days := range ss {
+		for date, sk := range days {
+			all = append(all, dailySketch{shortURL, date, sk})
+		}
+	}
+	return all
+}
+
+const visitorsFlushInterval = time.Minute
+
+// visitorCounter accumulates the sketches of the recent clicks in memory
+// and periodically merges them into the storage.
+type visitorCounter struct {
+	mu      sync.Mutex
+	pending sketches
+	st      storage
+	log     logger
+}
+
+// The sketches are merged periodically until the context is done.
+func newVisitorCounter(ctx context.Context, st storage, log logger) *visitorCounter {
+	vc := &visitorCounter{pending: make(sketches), st: st, log: log}
+	go every(ctx, visitorsFlushInterval, vc.persist)
+
+	return vc
+}
+
+// add counts a visitor as a distinct combination of the client IP and user agent.
+func (vc *visitorCounter) add(clicks []click) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for _, c := range clicks {
+		sk := vc.pending.get(c.shortURL, c.at.UTC().Format(dateLayout))
+		sk.Insert([]byte(c.ipHash + "|" + c.userAgent))
+	}
+}
+
+// persist is the periodic flush, which reports the failures rather than returning them.
+func (vc *visitorCounter) persist(ctx context.Context, _ time.Time) {
+	if err := vc.flush(ctx); err != nil {
+		vc.log.Error(err, "persisting visitor sketches")
+	}
+}
+
+// flush keeps the pending sketches for the next attempt when the storage fails.
+func (vc *visitorCounter) flush(ctx context.Context) error {
+	vc.mu.Lock()
+	flushed := vc.pending
+	vc.pending = make(sketches)
+	vc.mu.Unlock()
+
+	if len(flushed) == 0 {
+		return nil
+	}
+
+	err := vc.st.StoreSketches(ctx, flushed.all())
+	if err != nil {
+		vc.mu.Lock()
+		for _, ds := range flushed.all() {
+			if mergeErr := vc.pending.merge(ds); mergeErr != nil {
+				err = errors.Join(err, mergeErr)
+			}
+		}
+		vc.mu.Unlock()
+	}
+	return err
+}
+
+// visitors estimates the unique visitors of a short URL per day and overall.
+func (vc *visitorCounter) visitors(ctx context.Context, shortURL string) (map[string]uint64, uint64, error) {
+	stored, err := vc.st.LoadSketches(ctx, shortURL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	vc.mu.Lock()
+	pending := vc.pending.daily(shortURL)
+	vc.mu.Unlock()
+
+	merged := make(sketches)
+	for _, ds := range append(stored, pending...) {
+		if err = merged.merge(ds); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	daily := make(map[string]uint64)
+	total := hyperloglog.New()
+	for date, sk := range merged[shortURL] {
+		daily[date] = sk.Estimate()
+		if err = total.Merge(sk); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return daily, total.Estimate(), nil
+}